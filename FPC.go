@@ -2,19 +2,20 @@ package main
 
 import (
     "compress/gzip"
-    "crypto/md5"
-    "encoding/hex"
     _ "encoding/json"
     "encoding/json"
     "fmt"
+    "html"
     "io"
     "log"
+    "net"
     "net/http"
     "net/http/pprof"
     "os"
     "path/filepath"
     "runtime"
     "runtime/trace"
+    "strconv"
     "strings"
     "sync"
     "time"
@@ -22,15 +23,14 @@ import (
     "github.com/fatih/color"
     "github.com/go-redis/redis/v8"
     "github.com/joho/godotenv"
-    "github.com/patrickmn/go-cache"
     "golang.org/x/net/context"
     "golang.org/x/time/rate"
 )
 
 var (
     ctx         = context.Background()  // Context for Redis operations
-    rdb         *redis.Client          // Redis client instance for persistent cache
-    localCache  *cache.Cache           // In-memory cache for fast access
+    rdb         redis.UniversalClient  // Redis client instance for persistent cache
+    localCache  pageStore              // In-memory cache for fast access
     corePrefix  = "zc:k:"             // Core prefix for all cache keys
     prefix      string                // Combined prefix (core + config) for cache keys
     debug       bool                  // Debug mode flag for verbose logging
@@ -59,23 +59,119 @@ type CacheConfig struct {
     RedisHost   string
     RedisPort   string
     RedisDB     int
+    RedisMode   string
+    RedisAddrs  string
+    RedisUsername string
+    RedisPassword string
+    SentinelMaster   string
+    SentinelUsername string
+    SentinelPassword string
+    RedisTLS           bool
+    RedisTLSCA         string
+    RedisTLSCert       string
+    RedisTLSKey        string
+    RedisTLSServerName string
+    RedisTLSInsecure   bool
     UseHTTPS    bool
     Host        string
+    PreserveHost bool
+    Stores      storeMap
+    StoreViews  storeViews
+    CurrencyCookie string
+    CryptKey       string
+    DesignExceptions []designException
+    QueryNormalize   bool
+    QueryStripParams []string
+    CachedHeaders    headerPolicy
+    ESI              bool
+    ESIMaxDepth      int
+    ESITimeout       time.Duration
+    Coalesce         bool
+    CoalesceTimeout  time.Duration
+    RefreshWorkers   int
+    RefreshQueue     int
+    GraceTTL         time.Duration
+    GraceMaxBytes    int64
+    BackendTimeout   time.Duration
+    OriginCacheControl bool
     Prefix      string
     Debug       bool
     CacheTTL    time.Duration
     UseCache    bool
     UseStale    bool
     StaleExpiry time.Duration
+    CacheMaxBytes   int64
+    CacheMaxEntries int
+    CacheEviction   string
+    CacheShards     int
+    DiskDir             string
+    DiskMaxBytes        int64
+    DiskWriteQueue      int
+    DiskCompactInterval time.Duration
     EnableProfile bool
     ProfilePort   string
     SecretKey    string
+    MagentoVersion string
+    WriteThrough   bool
+    WriteWorkers   int
+    WriteQueue     int
+    RedisTTL       time.Duration
+    CompressData   int
+    CompressTags   int
+    CompressThreshold int
+    CompressionLib string
+    PurgeAllow     []*net.IPNet
+    KeyspaceEvents bool
+    KeyspaceConfigure bool
+    RedisTimeout         time.Duration
+    RedisPurgeTimeout    time.Duration
+    RedisHealthInterval  time.Duration
+    RedisBreakerFailures int
+    RedisBreakerCooldown time.Duration
 }
 
 type CacheEntry struct {
     Content  string            `json:"content"`
-    Headers  map[string]string `json:"headers"`
+    Headers  http.Header       `json:"headers"`
     Expired  bool             `json:"expired"`
+    Tags     []string          `json:"tags,omitempty"`
+    Created  time.Time         `json:"created"`            // When the origin generated the page
+    Lifetime time.Duration     `json:"lifetime,omitempty"` // Origin lifetime, 0 when the page never expires
+    Status   int               `json:"status,omitempty"`   // Backend status, 0 means 200
+    NoStore  string            `json:"-"`                  // Why the backend response must not be cached
+}
+
+// ExpiresAt is when the origin stops serving the page, zero when it never does
+func (e CacheEntry) ExpiresAt() time.Time {
+    if e.Lifetime <= 0 || e.Created.IsZero() {
+        return time.Time{}
+    }
+    return e.Created.Add(e.Lifetime)
+}
+
+// Age is how long ago the origin generated the page
+func (e CacheEntry) Age(now time.Time) time.Duration {
+    if e.Created.IsZero() || now.Before(e.Created) {
+        return 0
+    }
+    return now.Sub(e.Created)
+}
+
+// localTTL caps ttl to the lifetime the origin has left for entry. It returns
+// false once the origin considers the page expired, so it must not be kept.
+func localTTL(entry CacheEntry, ttl time.Duration) (time.Duration, bool) {
+    expiresAt := entry.ExpiresAt()
+    if expiresAt.IsZero() {
+        return ttl, true
+    }
+    left := time.Until(expiresAt)
+    if left <= 0 {
+        return 0, false
+    }
+    if left < ttl {
+        return left, true
+    }
+    return ttl, true
 }
 
 // init initializes the FPC service with Redis and local cache configuration
@@ -86,54 +182,136 @@ func init() {
 
     config := loadConfig()
     prefix = corePrefix + config.Prefix
+    if config.WriteThrough {
+        checkCompressionLib(config.CompressionLib)
+    }
+    checkVarySalt(config)
 
     // Initialize Redis client
-    rdb = redis.NewClient(&redis.Options{
-        Addr:     fmt.Sprintf("%s:%s", config.RedisHost, config.RedisPort),
-        DB:       config.RedisDB,
-        Password: "",
-    })
-
-    // Test Redis connection
-    _, err := rdb.Ping(ctx).Result()
+    client, err := newRedisClient(config)
     if err != nil {
-        warnLog("Warning: Redis connection failed: %v. Working in proxy mode with local cache only.\n", err)
-        rdb = nil // Set to nil to indicate Redis is unavailable
+        errorLog("Invalid Redis configuration: %v. Working in proxy mode with local cache only.\n", err)
         config.UseCache = true // Force enable local cache in proxy mode
+    } else {
+        rdb = client
+
+        // Test Redis connection, the monitor keeps reconnecting if it is down
+        err = rdb.Ping(ctx).Err()
+        redisState.setConnected(err)
+        if err != nil {
+            warnLog("Warning: Redis connection failed: %v. Working in proxy mode with local cache only, reconnecting in background.\n", err)
+            config.UseCache = true // Force enable local cache in proxy mode
+        }
     }
+    checkQueryNormalize(config, rdb != nil)
 
     // Initialize local cache
     if config.UseCache {
-        localCache = cache.New(config.CacheTTL, config.StaleExpiry)
+        localCache = newLocalStore(config)
+        // Keep expired pages once as stale unless Magento's own lifetime
+        // for the page is over. Purged and evicted pages are gone for good.
         if config.UseStale {
-            localCache.OnEvicted(func(key string, value interface{}) {
-                if entry, ok := value.(CacheEntry); ok {
-                    entry.Expired = true
-                    localCache.Set(key, entry, config.StaleExpiry)
+            localCache.setStaleCopy(func(entry CacheEntry) (CacheEntry, time.Duration, bool) {
+                if entry.Expired {
+                    return entry, 0, false
                 }
+                staleTTL, fresh := localTTL(entry, config.StaleExpiry)
+                entry.Expired = true
+                return entry, staleTTL, fresh
             })
         }
+        localCache.setOnRemoved(func(key string, entry CacheEntry, reason removalReason) {
+            // A page stored again meanwhile keeps its tags
+            if !localCache.Contains(key) {
+                localTags.remove(key)
+            }
+        })
+        localCache.startJanitor(time.Minute)
     }
+    initGrace(config)
+    initDisk(config)
+    httpClient.Timeout = config.BackendTimeout
 }
 
 // loadConfig loads and caches environment configuration using sync.Once
 func loadConfig() *CacheConfig {
     configOnce.Do(func() {
+        // Magento's env.php only fills variables that are not set explicitly
+        applyMagentoEnv(getEnv("MAGENTO_ROOT", ""))
+
         cachedConfig = &CacheConfig{
             RedisHost:   getEnv("REDIS_HOST", "127.0.0.1"),
             RedisPort:   getEnv("REDIS_PORT", "6379"),
             RedisDB:     getEnvInt("REDIS_DB", 11),
+            RedisMode:   getEnv("REDIS_MODE", redisModeStandalone),
+            RedisAddrs:  getEnv("REDIS_ADDRS", ""),
+            RedisUsername: getEnv("REDIS_USERNAME", ""),
+            RedisPassword: getEnv("REDIS_PASSWORD", ""),
+            SentinelMaster:   getEnv("REDIS_SENTINEL_MASTER", ""),
+            SentinelUsername: getEnv("REDIS_SENTINEL_USERNAME", ""),
+            SentinelPassword: getEnv("REDIS_SENTINEL_PASSWORD", ""),
+            RedisTLS:           getEnvBool("REDIS_TLS", false),
+            RedisTLSCA:         getEnv("REDIS_TLS_CA", ""),
+            RedisTLSCert:       getEnv("REDIS_TLS_CERT", ""),
+            RedisTLSKey:        getEnv("REDIS_TLS_KEY", ""),
+            RedisTLSServerName: getEnv("REDIS_TLS_SERVER_NAME", ""),
+            RedisTLSInsecure:   getEnvBool("REDIS_TLS_INSECURE", false),
             UseHTTPS:    getEnvBool("HTTPS", true),
             Host:        getEnv("HOST", ""),
+            PreserveHost: getEnvBool("PRESERVE_HOST", false),
+            Stores:      parseStoreMap(getEnv("STORE_MAP", "")),
+            StoreViews:  parseStoreViews(getEnv("STORE_VIEWS", "")),
+            CurrencyCookie: getEnv("CURRENCY_COOKIE", ""),
+            CryptKey:       getEnv("CRYPT_KEY", ""),
+            DesignExceptions: parseDesignExceptions(getEnv("DESIGN_EXCEPTIONS", "")),
+            QueryNormalize:   getEnvBool("QUERY_NORMALIZE", false),
+            QueryStripParams: parseStripParams(getEnv("QUERY_STRIP_PARAMS", defaultStripParams)),
+            CachedHeaders:    parseHeaderPolicy(getEnv("CACHE_HEADERS_ALLOW", ""), getEnv("CACHE_HEADERS_DENY", defaultDenyHeaders)),
+            ESI:              getEnvBool("ESI", false),
+            ESIMaxDepth:      getEnvInt("ESI_MAX_DEPTH", 3),
+            ESITimeout:       time.Duration(getEnvInt("ESI_TIMEOUT_MS", 2000)) * time.Millisecond,
+            Coalesce:         getEnvBool("COALESCE", true),
+            CoalesceTimeout:  time.Duration(getEnvInt("COALESCE_TIMEOUT_MS", 5000)) * time.Millisecond,
+            RefreshWorkers:   getEnvInt("REFRESH_WORKERS", 4),
+            RefreshQueue:     getEnvInt("REFRESH_QUEUE", 1000),
+            GraceTTL:         time.Duration(getEnvInt("GRACE_TTL", 86400)) * time.Second,
+            GraceMaxBytes:    int64(getEnvInt("GRACE_MAX_MB", 256)) << 20,
+            BackendTimeout:   time.Duration(getEnvInt("BACKEND_TIMEOUT_MS", 30000)) * time.Millisecond,
+            OriginCacheControl: getEnvBool("ORIGIN_CACHE_CONTROL", true),
             Prefix:      getEnv("PREFIX", "b30_"),
             Debug:       getEnvBool("DEBUG", false),
             CacheTTL:    time.Duration(getEnvInt("CACHE_TTL", 60)) * time.Second,
             UseCache:    getEnvBool("USE_CACHE", false),
             UseStale:    getEnvBool("USE_STALE", true),
             StaleExpiry: time.Duration(getEnvInt("STALE_TTL", 432000)) * time.Second, // 5 days = 432000 seconds
+            CacheMaxBytes:   int64(getEnvInt("CACHE_MAX_MB", 512)) << 20,
+            CacheMaxEntries: getEnvInt("CACHE_MAX_ENTRIES", 0),
+            CacheEviction:   strings.ToLower(getEnv("CACHE_EVICTION", "lru")),
+            CacheShards:     getEnvInt("CACHE_SHARDS", 1),
+            DiskDir:             getEnv("DISK_CACHE_DIR", ""),
+            DiskMaxBytes:        int64(getEnvInt("DISK_MAX_MB", 1024)) << 20,
+            DiskWriteQueue:      getEnvInt("DISK_WRITE_QUEUE", 1000),
+            DiskCompactInterval: time.Duration(getEnvInt("DISK_COMPACT_INTERVAL", 300)) * time.Second,
             EnableProfile: getEnvBool("ENABLE_PROFILE", true),
             ProfilePort:  getEnv("PROFILE_PORT", "6060"),
             SecretKey:    getEnv("SECRET_KEY", "changeme"),
+            MagentoVersion: getEnv("MAGENTO_VERSION", "2.4.7"),
+            WriteThrough:   getEnvBool("REDIS_WRITE_THROUGH", false),
+            WriteWorkers:   getEnvInt("REDIS_WRITE_WORKERS", 4),
+            WriteQueue:     getEnvInt("REDIS_WRITE_QUEUE", 1000),
+            RedisTTL:       time.Duration(getEnvInt("REDIS_TTL", 86400)) * time.Second,
+            CompressData:   getEnvInt("COMPRESS_DATA", 1),
+            CompressTags:   getEnvInt("COMPRESS_TAGS", 1),
+            CompressThreshold: getEnvInt("COMPRESS_THRESHOLD", 20480),
+            CompressionLib: getEnv("COMPRESSION_LIB", "gzip"),
+            PurgeAllow:     parseNetworks(getEnv("PURGE_ALLOW", "127.0.0.1,::1")),
+            KeyspaceEvents: getEnvBool("KEYSPACE_EVENTS", true),
+            KeyspaceConfigure: getEnvBool("KEYSPACE_CONFIGURE", false),
+            RedisTimeout:         time.Duration(getEnvInt("REDIS_TIMEOUT_MS", 100)) * time.Millisecond,
+            RedisPurgeTimeout:    time.Duration(getEnvInt("REDIS_PURGE_TIMEOUT_MS", 10000)) * time.Millisecond,
+            RedisHealthInterval:  time.Duration(getEnvInt("REDIS_HEALTH_INTERVAL_MS", 2000)) * time.Millisecond,
+            RedisBreakerFailures: getEnvInt("REDIS_BREAKER_FAILURES", 5),
+            RedisBreakerCooldown: time.Duration(getEnvInt("REDIS_BREAKER_COOLDOWN", 10)) * time.Second,
         }
     })
     return cachedConfig
@@ -148,6 +326,10 @@ var httpClient = &http.Client{
         MaxIdleConnsPerHost: 10,
     },
     Timeout: time.Second * 30,
+    // Redirects are answered to the client, not followed for it
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        return http.ErrUseLastResponse
+    },
 }
 
 func main() {
@@ -165,14 +347,33 @@ func main() {
     // Register cache listing endpoint
     http.HandleFunc("/cache/list", handleSecuredCacheList)
 
+    // Register purge-by-tag endpoint
+    http.HandleFunc("/cache/purge", handleSecuredPurge)
+
+    // Register statistics endpoint
+    http.HandleFunc("/cache/stats", handleSecuredStats)
+
+    // Refresh stale pages with a bounded pool of workers
+    revalidation = startRevalidator(config)
+    if config.WriteThrough && rdb != nil {
+        writeThrough = startRedisWriter(config)
+    }
+
+    // Reconnect Redis in the background and evict local pages when Magento changes Redis
+    if rdb != nil {
+        go monitorRedis(config)
+    }
+
     // Log startup information
     infoLog("FPC Server starting:\n")
     infoLog("- Port: %s\n", port)
     infoLog("- Backend: %s://%s\n", map[bool]string{true: "https", false: "http"}[config.UseHTTPS], config.Host)
-    infoLog("- Redis: %s:%s (DB: %d)\n", config.RedisHost, config.RedisPort, config.RedisDB)
+    infoLog("- Redis: %s [%s]\n", describeRedis(config), redisState.State())
     infoLog("- Cache: %v (TTL: %.0fs)\n", config.UseCache, config.CacheTTL.Seconds())
     infoLog("- Cache List URL: http://localhost:%s/cache/list (Secret Key Required)\n", port)
     infoLog("- Cache List JSON: http://localhost:%s/cache/list?format=json\n", port)
+    infoLog("- Cache Stats URL: http://localhost:%s/cache/stats (Secret Key Required)\n", port)
+    infoLog("- Cache Purge URL: http://localhost:%s/cache/purge?tags=cat_p_1 (Secret Key Required)\n", port)
 
 
 	fmt.Println(`
@@ -247,6 +448,12 @@ func initProfiler(config *CacheConfig) {
 
 // handleRequest processes HTTP requests with multi-level caching strategy
 func handleRequest(w http.ResponseWriter, r *http.Request) {
+    // Cache invalidation from Magento (http_cache_hosts) is never rate limited
+    if r.Method == "PURGE" {
+        handleVarnishPurge(w, r)
+        return
+    }
+
     // Wait for rate limiter
     if err := requestLimiter.Wait(context.Background()); err != nil {
         errorLog("Rate limit exceeded: %v\n", err)
@@ -256,6 +463,7 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 
     startTime := time.Now()
     config := loadConfig()  // Load once at the start
+    w.Header().Set("Fast-Cache-Redis", redisState.State())
 
     // This deferred function will run at the end of handleRequest
     defer func() {
@@ -269,45 +477,43 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
         }
     }()
 
-    // If request is not cacheable (e.g., /media, /admin, non-GET), proxy directly to backend
-    if !isCacheable(r) {
-        // Track timing for direct proxy requests
-        requestStart := time.Now()
+    // Requests Magento could not build an identifier for are never cached either
+    cacheable := isCacheable(r) && !storeCookieWithoutVary(r, config)
+    var cacheKey string
+    if cacheable {
+        cacheKey = getCacheKeyWithConfig(r, config)
+        cacheable = cacheKey != ""
+    }
 
+    // If request is not cacheable (e.g., /media, /admin, non-GET), proxy directly to backend
+    if !cacheable {
         // Add debug headers and logging for non-cacheable URLs
         if config.Debug {
             w.Header().Set("Fast-Cache", "FALSE")
             debugLog("REQUEST URL: %s", r.URL.Path)
         }
 
-        // Forward request to backend server
-        entry, err := proxyRequest(w, r)
-        if err != nil {
-            errorLog("Proxy error: %v\n", err)
-            w.WriteHeader(http.StatusBadGateway)
-            return
-        }
-
-        // Add proxy timing information to response headers
-        w.Header().Set("X-Proxy-Time", fmt.Sprintf("%.2fms", time.Since(requestStart).Seconds()*1000))
-
-        // Serve the proxied content directly without caching
-        serveContent(w, *entry, startTime)
+        // Forward request and response unchanged
+        proxyPassThrough(w, r)
         return
     }
 
-    // Pass config to functions that need it
-    cacheKey := getCacheKeyWithConfig(r, config)
+    if config.QueryNormalize {
+        queryStats.observe(r.URL.Path+"?"+r.URL.RawQuery, r.URL.Path+"?"+normalizeQuery(r.URL.RawQuery, config))
+    }
+
     if config.Debug {
         debugLog("\n🔑 Cache Key: %s\n", cacheKey)
         debugLog("📍 URL: %s\n", getUrl(r))
     }
 
+    // A Refresh: 1 request skips both cache tiers and replaces the page
+    refresh := wantsRefresh(r, config)
+
     // Try local cache first
-    if config.UseCache {
+    if config.UseCache && !refresh {
         cacheStart := time.Now()
-        if entry, found := localCache.Get(cacheKey); found {
-            cacheEntry := entry.(CacheEntry)
+        if cacheEntry, found := localCache.Get(cacheKey); found {
             w.Header().Set("X-Cache-Lookup-Time", fmt.Sprintf("%.2fms", time.Since(cacheStart).Seconds()*1000))
             
             if config.Debug {
@@ -319,46 +525,51 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 
             // Async refresh for stale content
             if cacheEntry.Expired {
-                go func() {
-                    if entry, err := proxyRequest(w, r); err == nil {
-                        localCache.Set(cacheKey, *entry, config.CacheTTL)
-                    }
-                }()
+                revalidation.schedule(r, cacheKey)
             }
 
-            serveContent(w, cacheEntry, startTime)
+            cacheStatus := "HIT"
+            if cacheEntry.Expired {
+                cacheStatus = "STALE"
+            }
+            serveContent(w, assembleESI(r, cacheEntry, config), startTime, cacheStatus)
             return
         } else if config.Debug {
             warnLog("❌ Cache MISS (Local)\n")
         }
+
+        // Then the disk, which survives restarts
+        if cacheEntry, found := diskCache.load(cacheKey); found {
+            if config.Debug {
+                infoLog("✅ Cache HIT (Disk) in %.4fms\n", time.Since(cacheStart).Seconds()*1000)
+            }
+            cacheStatus := "HIT"
+            if cacheEntry.Expired {
+                revalidation.schedule(r, cacheKey)
+                cacheStatus = "STALE"
+            }
+            serveContent(w, assembleESI(r, cacheEntry, config), startTime, cacheStatus)
+            return
+        }
     }
 
     // Try Redis if available
-    if rdb != nil {
+    if !refresh && redisState.allow() {
         redisStart := time.Now()
-        content, err := rdb.Get(ctx, cacheKey).Bytes()
+        redisCtx, cancel := redisContext()
+        entry, err := loadRedisEntry(redisCtx, cacheKey)
+        cancel()
         if err == nil {
             if config.Debug {
                 infoLog("✅ Cache HIT (Redis) in %.2fms\n", time.Since(redisStart).Seconds()*1000)
             }
-            reader, _ := gzip.NewReader(strings.NewReader(string(content)))
-            if reader != nil {
-                defer reader.Close()
-                if decompressed, err := io.ReadAll(reader); err == nil {
-                    entry := CacheEntry{
-                        Content: string(decompressed),
-                        Headers: map[string]string{
-                            "Content-Type": "text/html; charset=UTF-8",
-                        },
-                        Expired: false,
-                    }
-                    if config.UseCache {
-                        localCache.Set(cacheKey, entry, config.CacheTTL)
-                    }
-                    serveContent(w, entry, startTime)
-                    return
-                }
+            if config.UseCache {
+                setLocal(cacheKey, *entry, config)
             }
+            serveContent(w, assembleESI(r, *entry, config), startTime, "HIT")
+            return
+        } else if err != redis.Nil {
+            errorLog("Redis entry %s skipped: %v\n", cacheKey, err)
         } else if config.Debug {
             warnLog("❌ Cache MISS (Redis)\n")
         }
@@ -369,7 +580,18 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
         errorLog("❌ Cache MISS (All) - Proxying to backend\n")
     }
     proxyStart := time.Now()
-    entry, err := proxyRequest(w, r)
+    // Concurrent misses for the same key share one backend request
+    entry, err := coalescer.fetch(w, r, cacheKey, config)
+    if err == errClientGone {
+        if config.Debug {
+            debugLog("Client left while waiting for %s\n", cacheKey)
+        }
+        return
+    }
+    // Grace mode: an outage or a broken render answers with the last good copy
+    if reason, failed := backendFailure(entry, err); failed && serveGrace(w, r, cacheKey, reason, startTime, config) {
+        return
+    }
     if err != nil {
         errorLog("Proxy error: %v\n", err)
         w.WriteHeader(http.StatusBadGateway)
@@ -377,12 +599,46 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
     }
     w.Header().Set("X-Proxy-Time", fmt.Sprintf("%.2fms", time.Since(proxyStart).Seconds()*1000))
 
-    // Store in local cache
+    if entry.NoStore != "" {
+        serveUncached(w, *entry)
+        return
+    }
+    serveContent(w, assembleESI(r, *entry, config), startTime, "MISS")
+}
+
+// serveUncached relays a response that must not be cached the way the backend
+// sent it: its status and all of its headers, so a private page keeps its
+// no-store and its cookies
+func serveUncached(w http.ResponseWriter, entry CacheEntry) {
+    for key, values := range entry.Headers {
+        w.Header()[key] = append([]string(nil), values...)
+    }
+    status := entry.Status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    w.WriteHeader(status)
+    io.WriteString(w, entry.Content)
+}
+
+// storeEntry saves a freshly fetched page in the local cache and, with write-through
+// enabled, in Redis so other FPC nodes and Magento itself can reuse it
+func storeEntry(cacheKey string, entry CacheEntry, config *CacheConfig) {
+    if entry.NoStore != "" {
+        if config.Debug {
+            warnLog("🚫 Not storing %s: %s\n", cacheKey, entry.NoStore)
+        }
+        return
+    }
+
+    entry = cachedCopy(entry, config)
     if config.UseCache {
-        localCache.Set(cacheKey, *entry, config.CacheTTL)
+        setLocal(cacheKey, entry, config)
     }
 
-    serveContent(w, *entry, startTime)
+    if config.WriteThrough {
+        writeThrough.save(cacheKey, entry)
+    }
 }
 
 // proxyRequest forwards requests to backend server and handles gzip compression
@@ -392,16 +648,24 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) (*CacheEntry, error) {
     if config.UseHTTPS {
         scheme = "https"
     }
+    // The backend always gets the original query, including parameters left out of the key
     backendURL := fmt.Sprintf("%s://%s%s", scheme, config.Host, r.URL.Path)
+    if r.URL.RawQuery != "" {
+        backendURL += "?" + r.URL.RawQuery
+    }
     
     // Create new request
-    proxyReq, err := http.NewRequest(r.Method, backendURL, nil)
+    proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, backendURL, nil)
     if err != nil {
         return nil, err
     }
 
-    // Copy original headers
-    proxyReq.Header = r.Header
+    // Copy original headers; the stale refresh runs after the client's request is done
+    proxyReq.Header = r.Header.Clone()
+    // Let the web server in front of Magento pick the store for the client's host
+    if config.PreserveHost {
+        proxyReq.Host = r.Host
+    }
     // Add Accept-Encoding header to handle gzip
     proxyReq.Header.Set("Accept-Encoding", "gzip")
 
@@ -413,16 +677,18 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) (*CacheEntry, error) {
     defer resp.Body.Close()
 
     var reader io.ReadCloser = resp.Body
-    var isGzipped bool
+
+    // The client gets every backend header; only the stored copy is filtered
+    headers := liveHeaders(resp.Header)
 
     // Check if response is gzipped
     if resp.Header.Get("Content-Encoding") == "gzip" {
+        headers.Del("Content-Encoding")
         reader, err = gzip.NewReader(resp.Body)
         if err != nil {
             return nil, err
         }
         defer reader.Close()
-        isGzipped = true
     }
 
     // Read body
@@ -438,35 +704,51 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) (*CacheEntry, error) {
     // Create cache entry
     entry := &CacheEntry{
         Content: string(body),
-        Headers: map[string]string{
-            "Content-Type": resp.Header.Get("Content-Type"),
-        },
+        Headers: headers,
         Expired: false,
+        Tags:    parseTags(resp.Header.Get(magentoTagsHeader)),
+        Created:  time.Now(),
+        Status:   resp.StatusCode,
     }
-
-    // Don't store gzip header in cache
-    if isGzipped {
-        delete(entry.Headers, "Content-Encoding")
+    if ttl, ok, reason := responseLifetime(resp, config); ok {
+        entry.Lifetime = ttl
+    } else {
+        entry.NoStore = reason
     }
 
     return entry, nil
 }
 
-// serveContent writes cache entry content to HTTP response with headers
-func serveContent(w http.ResponseWriter, entry CacheEntry, startTime time.Time) {
+// serveContent writes cache entry content to HTTP response with headers.
+// cacheStatus (HIT, STALE or MISS) is reported in the Fast-Cache header.
+func serveContent(w http.ResponseWriter, entry CacheEntry, startTime time.Time, cacheStatus string) {
     // Set cached headers
-    for key, value := range entry.Headers {
-        w.Header().Set(key, value)
+    for key, values := range entry.Headers {
+        w.Header()[key] = append([]string(nil), values...)
     }
 
-    w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-    w.Header().Set("Fast-Cache", "HIT")
+    if w.Header().Get("Content-Type") == "" {
+        w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+    }
+    w.Header().Set("Fast-Cache", cacheStatus)
     w.Header().Set("Fast-Cache-Time", fmt.Sprintf("%.2fms", time.Since(startTime).Seconds()*1000))
     w.Header().Set("Fast-Cache-Length", fmt.Sprintf("%d", len(entry.Content)))
 
+    // Age and remaining lifetime are relative to when Magento generated the page
+    now := time.Now()
+    w.Header().Set("Age", strconv.Itoa(int(entry.Age(now).Seconds())))
+    if expiresAt := entry.ExpiresAt(); !expiresAt.IsZero() {
+        left := expiresAt.Sub(now)
+        if left < 0 {
+            left = 0 // Grace copies outlive their lifetime
+        }
+        w.Header().Set("Fast-Cache-TTL", strconv.Itoa(int(left.Seconds())))
+    }
+
     // Add debug information at the end of HTML content
     content := entry.Content
-    if config := loadConfig(); config.Debug {
+    isHTML := strings.HasPrefix(w.Header().Get("Content-Type"), "text/html")
+    if config := loadConfig(); config.Debug && isHTML {
         debugInfo := fmt.Sprintf(`
 <!-- Fast-Cache Debug Info:
      Time: %.2fms
@@ -484,103 +766,13 @@ func serveContent(w http.ResponseWriter, entry CacheEntry, startTime time.Time)
         content = strings.Replace(content, "</body>", debugInfo+"</body>", 1)
     }
 
-    // Write content with debug info
-    w.Write([]byte(content))
-}
-
-// getCacheKey generates cache key using Magento's logic
-func getCacheKey(r *http.Request) string {
-    config := loadConfig()  // Get config instance
-
-    // Check HTTPS flag
-    httpsFlag := r.Header.Get("X-Forwarded-Proto") == "https" || config.UseHTTPS
-
-    // Get URL with scheme and host
-    url := getUrl(r)
-
-    // Check for Magento vary cookie
-    var varyString interface{}
-    cookie, err := r.Cookie("X-Magento-Vary")
-    if err == nil {
-        varyString = cookie.Value
-    }
-
-    // Create cache key array similar to Magento
-    keyData := []interface{}{
-        httpsFlag,
-        url,
-        varyString,
-    }
-
-    // Generate JSON string and hash it
-    jsonBytes, _ := json.Marshal(keyData)
-    jsonStr := strings.Replace(string(jsonBytes), "/", "\\/", -1)
-
-    if config.Debug {
-        log.Printf("HASH-DATA: %s", jsonStr)
-    }
-
-    // Create SHA1 hash
-    h := md5.New()
-    h.Write([]byte(jsonStr))
-    return strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
-}
-
-// getCacheKeyWithConfig generates cache key using Magento's logic with provided config
-func getCacheKeyWithConfig(r *http.Request, config *CacheConfig) string {
-    // Check HTTPS flag
-    httpsFlag := r.Header.Get("X-Forwarded-Proto") == "https" || config.UseHTTPS
-
-    // Get URL with scheme and host
-    url := getUrl(r)
-
-    // Check for Magento vary cookie
-    var varyString interface{}
-    cookie, err := r.Cookie("X-Magento-Vary")
-    if err == nil {
-        varyString = cookie.Value
-    }
-
-    // Create cache key array similar to Magento
-    keyData := []interface{}{
-        httpsFlag,
-        url,
-        varyString,
-    }
-
-    // Generate JSON string and hash it
-    jsonBytes, _ := json.Marshal(keyData)
-    jsonStr := strings.Replace(string(jsonBytes), "/", "\\/", -1)
-
-    if config.Debug {
-        log.Printf("HASH-DATA: %s", jsonStr)
+    // Keep the backend status, so a 404 page stays a 404
+    if entry.Status != 0 && entry.Status != http.StatusOK {
+        w.WriteHeader(entry.Status)
     }
 
-    // Create SHA1 hash
-    h := md5.New()
-    h.Write([]byte(jsonStr))
-    return strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
-}
-
-// getUrl constructs full URL with scheme and host
-func getUrl(r *http.Request) string {
-    config := loadConfig()  // Get config instance
-
-    scheme := "http"
-    if r.Header.Get("X-Forwarded-Proto") == "https" || config.UseHTTPS {
-        scheme = "https"
-    }
-
-    host := r.Host
-    if config.Host != "" {
-        host = config.Host
-    }
-
-    url := fmt.Sprintf("%s://%s%s", scheme, host, r.URL.Path)
-    if config.Debug {
-        log.Printf("URL: %s", url)
-    }
-    return url
+    // Write content with debug info, without copying the page
+    io.WriteString(w, content)
 }
 
 // isCacheable determines if request should be cached based on method and path
@@ -659,7 +851,7 @@ func getEnvBool(key string, defaultValue bool) bool {
 // getEnvInt converts environment variable to integer with default fallback
 func getEnvInt(key string, defaultValue int) int {
     if value := os.Getenv(key); value != "" {
-        if i, err := fmt.Sscanf(value, "%d"); err == nil {
+        if i, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
             return i
         }
     }
@@ -672,12 +864,15 @@ type CacheKeyInfo struct {
     Size      int       `json:"size"`
     ExpiredAt string    `json:"expired_at,omitempty"`
     IsStale   bool      `json:"is_stale"`
+    Age       int       `json:"age"`
+    OriginExpiresAt string `json:"origin_expires_at,omitempty"`
+    Tags      []string  `json:"tags,omitempty"`
 }
 
-// Update the handleSecuredCacheList function
-func handleSecuredCacheList(w http.ResponseWriter, r *http.Request) {
+// authorizeAdmin checks the secret key of admin endpoints and answers 401 when it is wrong
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
     config := loadConfig()
-    
+
     // Check secret key from header or query parameter
     secretKey := r.Header.Get("X-Secret-Key")
     if secretKey == "" {
@@ -687,7 +882,15 @@ func handleSecuredCacheList(w http.ResponseWriter, r *http.Request) {
 
     if secretKey != config.SecretKey {
         w.WriteHeader(http.StatusUnauthorized)
-        errorLog("Unauthorized cache list access attempt\n")
+        errorLog("Unauthorized %s access attempt\n", r.URL.Path)
+        return false
+    }
+    return true
+}
+
+// Update the handleSecuredCacheList function
+func handleSecuredCacheList(w http.ResponseWriter, r *http.Request) {
+    if !authorizeAdmin(w, r) {
         return
     }
 
@@ -696,14 +899,21 @@ func handleSecuredCacheList(w http.ResponseWriter, r *http.Request) {
 
     // Get items from local cache
     for k, item := range localCache.Items() {
-        if entry, ok := item.Object.(CacheEntry); ok {
-            cacheKeys = append(cacheKeys, CacheKeyInfo{
-                Key:       k,
-                Size:      len(entry.Content),
-                ExpiredAt: time.Unix(0, item.Expiration).Format(time.RFC3339),
-                IsStale:   entry.Expired,
-            })
+        entry := item.Entry
+        info := CacheKeyInfo{
+            Key:     k,
+            Size:    len(entry.Content),
+            IsStale: entry.Expired,
+            Tags:    entry.Tags,
+            Age:     int(entry.Age(time.Now()).Seconds()),
         }
+        if item.Expiration > 0 {
+            info.ExpiredAt = time.Unix(0, item.Expiration).Format(time.RFC3339)
+        }
+        if expiresAt := entry.ExpiresAt(); !expiresAt.IsZero() {
+            info.OriginExpiresAt = expiresAt.Format(time.RFC3339)
+        }
+        cacheKeys = append(cacheKeys, info)
     }
 
     switch format {
@@ -716,6 +926,27 @@ func handleSecuredCacheList(w http.ResponseWriter, r *http.Request) {
     }
 }
 
+// handleSecuredStats reports cache subsystem statistics as JSON
+func handleSecuredStats(w http.ResponseWriter, r *http.Request) {
+    if !authorizeAdmin(w, r) {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "redis":    redisState.snapshot(),
+        "keyspace": keyspace.snapshot(),
+        "decode_errors": decodeErrorStats(),
+        "query":    queryStats.snapshot(),
+        "coalescing": coalescer.snapshot(),
+        "revalidation": revalidation.snapshot(),
+        "write_through": writeThrough.snapshot(),
+        "grace":    graceSnapshot(),
+        "local":    localSnapshot(),
+        "disk":     diskCache.snapshot(),
+    })
+}
+
 func serveHTMLCacheList(w http.ResponseWriter, keys []CacheKeyInfo) {
     tmpl := `<!DOCTYPE html>
     <html>
@@ -740,7 +971,9 @@ func serveHTMLCacheList(w http.ResponseWriter, keys []CacheKeyInfo) {
                 <th>Key</th>
                 <th>Size</th>
                 <th>Expires</th>
+                <th>Age</th>
                 <th>Status</th>
+                <th>Tags</th>
             </tr>
             %s
         </table>
@@ -755,12 +988,14 @@ func serveHTMLCacheList(w http.ResponseWriter, keys []CacheKeyInfo) {
             status = "stale"
             statusClass = "stale"
         }
-        rows += fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>%s</td><td class='%s'>%s</td></tr>",
+        rows += fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>%s</td><td>%ds</td><td class='%s'>%s</td><td>%s</td></tr>",
             k.Key,
             k.Size,
             k.ExpiredAt,
+            k.Age,
             statusClass,
-            status)
+            status,
+            html.EscapeString(strings.Join(k.Tags, ", ")))
     }
 
     fmt.Fprintf(w, tmpl, len(keys), rows)
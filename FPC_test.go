@@ -0,0 +1,203 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// useBackend points the proxy at handler for the duration of the test
+func useBackend(t *testing.T, handler http.HandlerFunc) *int64 {
+    t.Helper()
+    var calls int64
+    backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt64(&calls, 1)
+        handler(w, r)
+    }))
+
+    config := loadConfig()
+    saved, savedCache := *config, localCache
+    config.Host = strings.TrimPrefix(backend.URL, "http://")
+    config.UseHTTPS = false
+    config.UseCache = true
+    config.WriteThrough = false
+    config.ESI = false
+    localCache = newPageCache(0, 0, "lru")
+    t.Cleanup(func() {
+        backend.Close()
+        *config = saved
+        localCache = savedCache
+    })
+    return &calls
+}
+
+func getPage(path string) *httptest.ResponseRecorder {
+    rec := httptest.NewRecorder()
+    handleRequest(rec, httptest.NewRequest(http.MethodGet, "http://shop.example"+path, nil))
+    return rec
+}
+
+func TestUncacheableResponsesReachClientUnchanged(t *testing.T) {
+    tests := []struct {
+        name         string
+        status       int
+        cacheControl string
+        cookie       string
+    }{
+        {"set-cookie without public", http.StatusOK, "max-age=60", "store=de; path=/"},
+        {"no-store", http.StatusOK, "no-store, no-cache, must-revalidate", ""},
+        {"private", http.StatusOK, "private, max-age=60", "X-Magento-Vary=abc; path=/"},
+        {"redirect", http.StatusFound, "max-age=60", "store=de; path=/"},
+        {"server error", http.StatusServiceUnavailable, "max-age=60", ""},
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            calls := useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Cache-Control", tt.cacheControl)
+                w.Header().Set("Pragma", "no-cache")
+                if tt.cookie != "" {
+                    w.Header().Set("Set-Cookie", tt.cookie)
+                }
+                w.WriteHeader(tt.status)
+                w.Write([]byte("page"))
+            })
+            path := "/uncacheable-" + string(rune('a'+i))
+
+            for n := 1; n <= 2; n++ {
+                rec := getPage(path)
+                if rec.Code != tt.status {
+                    t.Errorf("request %d: status %d, want %d", n, rec.Code, tt.status)
+                }
+                if got := rec.Header().Get("Cache-Control"); got != tt.cacheControl {
+                    t.Errorf("request %d: Cache-Control %q, want %q", n, got, tt.cacheControl)
+                }
+                if got := rec.Header().Get("Pragma"); got != "no-cache" {
+                    t.Errorf("request %d: Pragma %q, want no-cache", n, got)
+                }
+                if got := rec.Header().Get("Set-Cookie"); got != tt.cookie {
+                    t.Errorf("request %d: Set-Cookie %q, want %q", n, got, tt.cookie)
+                }
+                if got := rec.Header().Get("Fast-Cache"); got != "" {
+                    t.Errorf("request %d: served as cached page (Fast-Cache: %s)", n, got)
+                }
+            }
+            if got := atomic.LoadInt64(calls); got != 2 {
+                t.Errorf("backend called %d times, want 2", got)
+            }
+        })
+    }
+}
+
+func TestCacheableMissKeepsCookiesButCachedCopyDoesNot(t *testing.T) {
+    calls := useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Header().Add("Set-Cookie", "store=de; path=/")
+        w.Header().Add("Set-Cookie", "X-Magento-Vary=abc; path=/")
+        w.Write([]byte("page"))
+    })
+
+    miss := getPage("/cacheable-switch")
+    if got := miss.Header().Get("Fast-Cache"); got != "MISS" {
+        t.Fatalf("first request Fast-Cache %q, want MISS", got)
+    }
+    if got := miss.Header().Values("Set-Cookie"); len(got) != 2 {
+        t.Errorf("miss Set-Cookie %q, want both backend cookies", got)
+    }
+    if got := miss.Header().Get("Cache-Control"); got != "public, max-age=60" {
+        t.Errorf("miss Cache-Control %q, want the backend's", got)
+    }
+
+    hit := getPage("/cacheable-switch")
+    if got := hit.Header().Get("Fast-Cache"); got != "HIT" {
+        t.Fatalf("second request Fast-Cache %q, want HIT", got)
+    }
+    if got := hit.Header().Values("Set-Cookie"); len(got) != 0 {
+        t.Errorf("hit replays Set-Cookie %q", got)
+    }
+    if got := atomic.LoadInt64(calls); got != 1 {
+        t.Errorf("backend called %d times, want 1", got)
+    }
+}
+
+func TestLocalTTLFollowsOriginExpiry(t *testing.T) {
+    now := time.Now()
+    tests := []struct {
+        name  string
+        entry CacheEntry
+        ttl   time.Duration
+        fresh bool
+    }{
+        {"no lifetime", CacheEntry{Created: now}, time.Hour, true},
+        {"lifetime longer than CACHE_TTL", CacheEntry{Created: now, Lifetime: 2 * time.Hour}, time.Hour, true},
+        {"lifetime ends first", CacheEntry{Created: now.Add(-50 * time.Minute), Lifetime: time.Hour}, 10 * time.Minute, true},
+        {"origin expired", CacheEntry{Created: now.Add(-2 * time.Hour), Lifetime: time.Hour}, 0, false},
+    }
+    for _, tt := range tests {
+        ttl, fresh := localTTL(tt.entry, time.Hour)
+        if fresh != tt.fresh || ttl > tt.ttl || ttl < tt.ttl-time.Second {
+            t.Errorf("%s: localTTL = %s, %v, want %s, %v", tt.name, ttl, fresh, tt.ttl, tt.fresh)
+        }
+    }
+
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+    loadConfig().CacheTTL = time.Hour
+    setLocal("EXPIRED", tests[3].entry, loadConfig())
+    if localCache.Contains("EXPIRED") {
+        t.Error("page past its origin expiry stored locally")
+    }
+    setLocal("SHORT", tests[2].entry, loadConfig())
+    item, ok := localCache.Items()["SHORT"]
+    if left := time.Until(time.Unix(0, item.Expiration)); !ok || left > 10*time.Minute {
+        t.Errorf("local copy lives %s, want at most the 10m Magento has left", left)
+    }
+}
+
+func TestServedPagesReportAgeAndTTL(t *testing.T) {
+    tests := []struct {
+        name  string
+        entry CacheEntry
+        age   string
+        ttl   []string // Acceptable Fast-Cache-TTL values, none for no header
+    }{
+        {"fresh", CacheEntry{Created: time.Now().Add(-100 * time.Second), Lifetime: 300 * time.Second}, "100", []string{"199", "200"}},
+        {"grace copy past its lifetime", CacheEntry{Created: time.Now().Add(-time.Hour), Lifetime: time.Minute}, "3600", []string{"0"}},
+        {"no lifetime", CacheEntry{Created: time.Now().Add(-5 * time.Second)}, "5", nil},
+        {"unknown creation", CacheEntry{}, "0", nil},
+    }
+    for _, tt := range tests {
+        rec := httptest.NewRecorder()
+        serveContent(rec, tt.entry, time.Now(), "HIT")
+        if got := rec.Header().Get("Age"); got != tt.age {
+            t.Errorf("%s: Age %q, want %q", tt.name, got, tt.age)
+        }
+        got, ok := rec.Header()["Fast-Cache-Ttl"]
+        if !ok {
+            if tt.ttl != nil {
+                t.Errorf("%s: no Fast-Cache-TTL, want %v", tt.name, tt.ttl)
+            }
+            continue
+        }
+        if !slices.Contains(tt.ttl, got[0]) {
+            t.Errorf("%s: Fast-Cache-TTL %q, want %v", tt.name, got, tt.ttl)
+        }
+    }
+
+    // A hit reports the lifetime the origin gave the page
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Write([]byte("page"))
+    })
+    getPage("/lifetime")
+    hit := getPage("/lifetime")
+    if hit.Header().Get("Fast-Cache") != "HIT" {
+        t.Fatalf("second request Fast-Cache %q, want HIT", hit.Header().Get("Fast-Cache"))
+    }
+    if ttl, _ := strconv.Atoi(hit.Header().Get("Fast-Cache-TTL")); ttl < 58 || ttl > 60 {
+        t.Errorf("hit Fast-Cache-TTL %q, want about 60", hit.Header().Get("Fast-Cache-TTL"))
+    }
+}
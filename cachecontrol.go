@@ -0,0 +1,117 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Magento copies the Cache-Control it decided on here when it rewrites the
+// public one for the browser
+const magentoCacheControlHeader = "X-Magento-Cache-Control"
+
+// cacheableStatus are the backend statuses Magento's Varnish VCL caches, plus
+// permanent redirects such as the 301s of URL rewrites
+var cacheableStatus = map[int]bool{
+    http.StatusOK:                true,
+    http.StatusNotFound:          true,
+    http.StatusMovedPermanently:  true,
+    http.StatusPermanentRedirect: true,
+}
+
+// cacheControl holds the directives of one or more Cache-Control headers
+type cacheControl map[string]string
+
+// parseCacheControl splits Cache-Control values into lower-cased directives
+func parseCacheControl(values ...string) cacheControl {
+    cc := cacheControl{}
+    for _, value := range values {
+        for _, part := range strings.Split(value, ",") {
+            name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+            name = strings.ToLower(strings.TrimSpace(name))
+            if name == "" {
+                continue
+            }
+            if _, seen := cc[name]; !seen {
+                cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+            }
+        }
+    }
+    return cc
+}
+
+// seconds returns a delta-seconds directive such as max-age
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+    arg, ok := cc[name]
+    if !ok {
+        return 0, false
+    }
+    n, err := strconv.Atoi(arg)
+    if err != nil || n < 0 {
+        return 0, true
+    }
+    return time.Duration(n) * time.Second, true
+}
+
+// responseLifetime decides whether a backend response may be stored and for
+// how long. The TTL comes from s-maxage, then max-age, then Expires, and
+// fallback applies when the origin sets none or ORIGIN_CACHE_CONTROL is off.
+// reason explains a refusal.
+func responseLifetime(resp *http.Response, config *CacheConfig) (ttl time.Duration, ok bool, reason string) {
+    fallback := config.RedisTTL
+    if !cacheableStatus[resp.StatusCode] {
+        return 0, false, "status " + strconv.Itoa(resp.StatusCode)
+    }
+    if !config.OriginCacheControl {
+        return fallback, true, ""
+    }
+
+    header := resp.Header.Values("Cache-Control")
+    if magento := resp.Header.Values(magentoCacheControlHeader); len(magento) > 0 {
+        header = magento
+    }
+    cc := parseCacheControl(header...)
+    for _, directive := range []string{"no-store", "no-cache", "private"} {
+        if _, found := cc[directive]; found {
+            return 0, false, "Cache-Control: " + directive
+        }
+    }
+    // Cookies belong to one visitor unless the page is explicitly public;
+    // Magento's VCL drops them from public pages and so does the cache, which
+    // never stores Set-Cookie
+    if _, public := cc["public"]; !public && len(resp.Header.Values("Set-Cookie")) > 0 {
+        return 0, false, "Set-Cookie"
+    }
+    // Pragma only counts for origins that send no Cache-Control at all
+    if len(header) == 0 && strings.Contains(strings.ToLower(resp.Header.Get("Pragma")), "no-cache") {
+        return 0, false, "Pragma: no-cache"
+    }
+
+    for _, directive := range []string{"s-maxage", "max-age"} {
+        if age, found := cc.seconds(directive); found {
+            if age <= 0 {
+                return 0, false, "Cache-Control: " + directive + "=0"
+            }
+            return age, true, ""
+        }
+    }
+
+    if expires := resp.Header.Get("Expires"); expires != "" {
+        at, err := http.ParseTime(expires)
+        if err != nil {
+            // RFC 9111: an invalid Expires, such as "0", means already expired
+            return 0, false, "Expires: " + expires
+        }
+        now := time.Now()
+        if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+            now = date
+        }
+        if !at.After(now) {
+            return 0, false, "Expires in the past"
+        }
+        return at.Sub(now), true, ""
+    }
+
+    return fallback, true, ""
+}
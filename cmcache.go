@@ -0,0 +1,359 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// Cm_Cache_Backend_Redis stores every cache record as a Redis HASH under
+// "zc:k:<id_prefix><ID>" with the fields below.
+const (
+    cmFieldData  = "d" // Serialized (and optionally compressed) payload
+    cmFieldTags  = "t" // Comma separated list of tags
+    cmFieldMtime = "m" // Unix time the record was saved
+    cmFieldInf   = "i" // 1 when the record has no lifetime
+
+    // Compressed payloads start with a 2 byte library code followed by this marker
+    cmCompressPrefix = ":\x1f\x8b"
+
+    cmTagIdsPrefix = "zc:ti:"  // SET of record ids per tag
+    cmTagsSet      = "zc:tags" // SET of all known tags
+    cmMaxLifetime  = 2592000 * time.Second
+
+    // Magento\PageCache\Model\Cache\Type tags every page with this
+    pageCacheTag = "FPC"
+)
+
+// magentoPage mirrors the array Magento\Framework\App\PageCache\Kernel serializes
+type magentoPage struct {
+    Content    string       `json:"content"`
+    StatusCode int          `json:"status_code"`
+    Status     int          `json:"status"`
+    Headers    phpHeaderMap `json:"headers"`
+}
+
+// magentoPageRecord is the payload written back in the layout Kernel::load expects
+type magentoPageRecord struct {
+    Content    string                 `json:"content"`
+    StatusCode int                    `json:"status_code"`
+    Headers    map[string]interface{} `json:"headers"`
+    Context    magentoPageContext     `json:"context"`
+}
+
+type magentoPageContext struct {
+    Data        map[string]string `json:"data"`
+    DefaultData map[string]string `json:"default_data"`
+}
+
+// phpHeaderMap decodes Laminas Headers::toArray() output, where a header is
+// either a single string or a list of values and an empty set is encoded as []
+type phpHeaderMap map[string][]string
+
+func (h *phpHeaderMap) UnmarshalJSON(data []byte) error {
+    *h = phpHeaderMap{}
+    if bytes.Equal(bytes.TrimSpace(data), []byte("[]")) {
+        return nil
+    }
+
+    var raw map[string]json.RawMessage
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return err
+    }
+    for name, value := range raw {
+        var values []string
+        if err := json.Unmarshal(value, &values); err == nil {
+            (*h)[name] = values
+            continue
+        }
+        var single interface{}
+        if err := json.Unmarshal(value, &single); err != nil {
+            return err
+        }
+        if single != nil {
+            (*h)[name] = []string{fmt.Sprint(single)}
+        }
+    }
+    return nil
+}
+
+// loadRedisEntry reads a page saved by Magento's page_cache frontend.
+// A missing record is reported as redis.Nil.
+func loadRedisEntry(ctx context.Context, cacheKey string) (*CacheEntry, error) {
+    // The key's TTL is the real lifetime; Cm_Cache only flags infinite records in "i"
+    var hmget *redis.SliceCmd
+    var pttl *redis.DurationCmd
+    _, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+        hmget = pipe.HMGet(ctx, prefix+cacheKey, cmFieldData, cmFieldTags, cmFieldMtime, cmFieldInf)
+        pttl = pipe.PTTL(ctx, prefix+cacheKey)
+        return nil
+    })
+    redisState.failure(err)
+    if err != nil {
+        return nil, err
+    }
+    fields := hmget.Val()
+    raw, ok := fields[0].(string)
+    if !ok {
+        return nil, redis.Nil
+    }
+
+    data, err := decodeCmCacheData([]byte(raw))
+    if err != nil {
+        return nil, err
+    }
+
+    var page magentoPage
+    if err := json.Unmarshal(data, &page); err != nil {
+        return nil, fmt.Errorf("cm_cache: invalid page payload: %w", err)
+    }
+
+    status := page.StatusCode
+    if status == 0 {
+        status = page.Status
+    }
+    if status != 0 && !cacheableStatus[status] {
+        return nil, fmt.Errorf("cm_cache: status %d pages are not replayed", status)
+    }
+
+    entry := &CacheEntry{
+        Content: page.Content,
+        Headers: loadConfig().CachedHeaders.filter(page.Headers),
+        Expired: false,
+        Status:  status,
+    }
+    if rawTags, ok := fields[1].(string); ok {
+        entry.Tags = decodeCmCacheTags(rawTags)
+    }
+    setCmCacheExpiry(entry, fields[2], fields[3], pttl.Val())
+    return entry, nil
+}
+
+// setCmCacheExpiry derives creation time and lifetime from the m and i fields
+// and the key's remaining TTL. The expiry comes from Redis alone, so clock
+// skew between Magento and this host only affects the reported age.
+func setCmCacheExpiry(entry *CacheEntry, mtime, inf interface{}, ttl time.Duration) {
+    now := time.Now()
+    entry.Created = now
+    if raw, ok := mtime.(string); ok {
+        if unix, err := strconv.ParseInt(raw, 10, 64); err == nil && unix > 0 && unix <= now.Unix() {
+            entry.Created = time.Unix(unix, 0)
+        }
+    }
+
+    // PTTL is -1 for keys without expiry
+    if raw, _ := inf.(string); raw == "1" || ttl < 0 {
+        entry.Lifetime = 0
+        return
+    }
+    entry.Lifetime = now.Add(ttl).Sub(entry.Created)
+}
+
+// decodeCmCacheTags turns the stored tag ids back into X-Magento-Tags names.
+// Magento tags are lower case, so undoing the prefix and upper-casing is enough.
+func decodeCmCacheTags(raw string) []string {
+    decoded, err := decodeCmCacheData([]byte(raw))
+    if err != nil || len(decoded) == 0 {
+        return nil
+    }
+
+    config := loadConfig()
+    var tags []string
+    for _, tagId := range strings.Split(string(decoded), ",") {
+        tag := strings.TrimPrefix(tagId, config.Prefix)
+        if tag != "" && tag != pageCacheTag {
+            tags = append(tags, strings.ToLower(tag))
+        }
+    }
+    return tags
+}
+
+// saveRedisEntry stores a page the way Cm_Cache_Backend_Redis::save does, so
+// Magento and other FPC nodes can load it and cache:clean can remove it.
+// lifetime counts from entry.Created; 0 stores the page without expiry.
+// The caller was let through by redisState.allow(), so every return settles
+// the call with the breaker, also one that never reached Redis.
+func saveRedisEntry(ctx context.Context, cacheKey string, entry CacheEntry, tags []string, lifetime time.Duration) (err error) {
+    reached := false
+    defer func() {
+        if reached {
+            redisState.failure(err)
+        } else {
+            redisState.release()
+        }
+    }()
+
+    config := loadConfig()
+    id := config.Prefix + cacheKey
+    key := prefix + cacheKey
+
+    mtime := entry.Created.Unix()
+    if entry.Created.IsZero() {
+        mtime = time.Now().Unix()
+    }
+    // The hash keeps the page's creation time, so the key expires lifetime after it
+    if !entry.Created.IsZero() && lifetime > 0 {
+        lifetime -= entry.Age(time.Now())
+        if lifetime <= 0 {
+            return nil
+        }
+    }
+
+    var payload bytes.Buffer
+    encoder := json.NewEncoder(&payload)
+    encoder.SetEscapeHTML(false)
+    status := entry.Status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    record := magentoPageRecord{
+        Content:    entry.Content,
+        StatusCode: status,
+        Headers:    make(map[string]interface{}, len(entry.Headers)),
+        Context: magentoPageContext{
+            Data:        map[string]string{},
+            DefaultData: map[string]string{},
+        },
+    }
+    // Laminas Headers::toArray() keeps a single value as a string
+    for name, values := range entry.Headers {
+        if len(values) == 1 {
+            record.Headers[name] = values[0]
+        } else {
+            record.Headers[name] = values
+        }
+    }
+    if err := encoder.Encode(record); err != nil {
+        return err
+    }
+    data, err := encodeCmCacheData(bytes.TrimRight(payload.Bytes(), "\n"), config.CompressData)
+    if err != nil {
+        return err
+    }
+
+    // Tags get the same prefix and normalization as ids. The caller's slice
+    // is shared with the cached entry, so it is not appended to.
+    all := append(append(make([]string, 0, len(tags)+1), tags...), pageCacheTag)
+    tagIds := make([]string, 0, len(all))
+    seen := make(map[string]bool, len(all))
+    for _, tag := range all {
+        tagId := config.Prefix + normalizeCacheId(tag)
+        if tag != "" && !seen[tagId] {
+            seen[tagId] = true
+            tagIds = append(tagIds, tagId)
+        }
+    }
+    tagData, err := encodeCmCacheData([]byte(strings.Join(tagIds, ",")), config.CompressTags)
+    if err != nil {
+        return err
+    }
+
+    // Drop the id from tags the previous version of the record had
+    reached = true
+    var oldTags []string
+    raw, err := rdb.HGet(ctx, key, cmFieldTags).Bytes()
+    switch {
+    case err == nil:
+        if decoded, err := decodeCmCacheData(raw); err == nil && len(decoded) > 0 {
+            oldTags = strings.Split(string(decoded), ",")
+        }
+    case err != redis.Nil:
+        return err
+    }
+
+    inf := 0
+    if lifetime <= 0 {
+        inf = 1
+    }
+    if lifetime > cmMaxLifetime {
+        lifetime = cmMaxLifetime
+    }
+
+    if config.KeyspaceEvents {
+        redisOwnWrites.mark(key)
+    }
+    _, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.HSet(ctx, key,
+            cmFieldData, data,
+            cmFieldTags, tagData,
+            cmFieldMtime, mtime,
+            cmFieldInf, inf)
+        if lifetime > 0 {
+            pipe.Expire(ctx, key, lifetime)
+        } else {
+            pipe.Persist(ctx, key)
+        }
+        for _, tag := range oldTags {
+            if !seen[tag] {
+                pipe.SRem(ctx, cmTagIdsPrefix+tag, id)
+            }
+        }
+        members := make([]interface{}, len(tagIds))
+        for i, tag := range tagIds {
+            pipe.SAdd(ctx, cmTagIdsPrefix+tag, id)
+            members[i] = tag
+        }
+        pipe.SAdd(ctx, cmTagsSet, members...)
+        return nil
+    })
+    return err
+}
+
+// encodeCmCacheData wraps data in the Cm_Cache envelope of COMPRESSION_LIB once
+// it reaches the compression threshold, like Cm_Cache_Backend_Redis::_encodeData
+func encodeCmCacheData(data []byte, level int) ([]byte, error) {
+    config := loadConfig()
+    if level <= 0 || len(data) < config.CompressThreshold {
+        return data, nil
+    }
+
+    prefix, codec := cmCodecFor(config.CompressionLib)
+    compressed, err := codec.encode(data, level)
+    if err != nil {
+        return nil, fmt.Errorf("cm_cache: %s: %w", codec.name, err)
+    }
+    return append([]byte(prefix+cmCompressPrefix), compressed...), nil
+}
+
+// decodeCmCacheData strips the Cm_Cache compression envelope from a payload,
+// see Cm_Cache_Backend_Redis::_decodeData
+func decodeCmCacheData(raw []byte) ([]byte, error) {
+    if len(raw) >= 5 && string(raw[2:5]) == cmCompressPrefix {
+        return decodeWith(string(raw[:2]), raw[5:])
+    }
+
+    // Plain gzip payloads written by earlier FastFPC versions
+    if len(raw) >= 2 && raw[0] == 0x1f && raw[1] == 0x8b {
+        return readAllFrom(gzip.NewReader(bytes.NewReader(raw)))
+    }
+
+    return raw, nil
+}
+
+// readAllFrom drains a decompressing reader, closing it afterwards. Output
+// beyond cmMaxDecodedSize is an error rather than an allocation.
+func readAllFrom(reader io.ReadCloser, err error) ([]byte, error) {
+    if err != nil {
+        return nil, fmt.Errorf("cm_cache: %w", err)
+    }
+    defer reader.Close()
+
+    data, err := io.ReadAll(io.LimitReader(reader, cmMaxDecodedSize+1))
+    if err != nil {
+        return nil, fmt.Errorf("cm_cache: %w", err)
+    }
+    if len(data) > cmMaxDecodedSize {
+        return nil, errors.New("cm_cache: decoded size exceeds limit")
+    }
+    return data, nil
+}
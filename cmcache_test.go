@@ -0,0 +1,359 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// fakeRedis speaks just enough RESP for the Cm_Cache commands FastFPC sends
+type fakeRedis struct {
+    mu      sync.Mutex
+    hashes  map[string]map[string]string
+    sets    map[string]map[string]bool
+    expires map[string]time.Time
+}
+
+// useFakeRedis points rdb at a fresh fakeRedis with a healthy breaker and
+// the cache prefix 69d_
+func useFakeRedis(t *testing.T) *fakeRedis {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f := &fakeRedis{
+        hashes:  make(map[string]map[string]string),
+        sets:    make(map[string]map[string]bool),
+        expires: make(map[string]time.Time),
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go f.serve(conn)
+        }
+    }()
+
+    config := loadConfig()
+    saved, savedRdb, savedPrefix, savedState := *config, rdb, prefix, redisState
+    config.Prefix = "69d_"
+    config.RedisTimeout = time.Second
+    prefix = corePrefix + config.Prefix
+    client := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+    rdb = client
+    redisState = &redisHealth{state: redisHealthy}
+    t.Cleanup(func() {
+        client.Close()
+        ln.Close()
+        *config = saved
+        rdb, prefix, redisState = savedRdb, savedPrefix, savedState
+    })
+    return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+    defer conn.Close()
+    r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+    for {
+        args, err := readRESPCommand(r)
+        if err != nil {
+            return
+        }
+        f.mu.Lock()
+        reply := f.exec(strings.ToUpper(args[0]), args[1:])
+        f.mu.Unlock()
+        writeRESP(w, reply)
+        if r.Buffered() == 0 {
+            w.Flush()
+        }
+    }
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+    if err != nil || n < 1 {
+        return nil, fmt.Errorf("bad command %q", line)
+    }
+    args := make([]string, n)
+    for i := range args {
+        if line, err = r.ReadString('\n'); err != nil {
+            return nil, err
+        }
+        size, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+        buf := make([]byte, size+2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        args[i] = string(buf[:size])
+    }
+    return args, nil
+}
+
+// writeRESP encodes nil, string, int, []interface{} and error replies
+func writeRESP(w *bufio.Writer, reply interface{}) {
+    switch v := reply.(type) {
+    case nil:
+        w.WriteString("$-1\r\n")
+    case string:
+        fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+    case int:
+        fmt.Fprintf(w, ":%d\r\n", v)
+    case error:
+        fmt.Fprintf(w, "-ERR %v\r\n", v)
+    case []interface{}:
+        fmt.Fprintf(w, "*%d\r\n", len(v))
+        for _, item := range v {
+            writeRESP(w, item)
+        }
+    }
+}
+
+func (f *fakeRedis) exec(cmd string, args []string) interface{} {
+    for key, at := range f.expires {
+        if time.Now().After(at) {
+            delete(f.hashes, key)
+            delete(f.expires, key)
+        }
+    }
+    switch cmd {
+    case "PING":
+        return "PONG"
+    case "HGET":
+        if value, ok := f.hashes[args[0]][args[1]]; ok {
+            return value
+        }
+        return nil
+    case "HMGET":
+        values := make([]interface{}, len(args)-1)
+        for i, field := range args[1:] {
+            if value, ok := f.hashes[args[0]][field]; ok {
+                values[i] = value
+            }
+        }
+        return values
+    case "HSET":
+        hash := f.hashes[args[0]]
+        if hash == nil {
+            hash = make(map[string]string)
+            f.hashes[args[0]] = hash
+        }
+        added := 0
+        for i := 1; i+1 < len(args); i += 2 {
+            if _, ok := hash[args[i]]; !ok {
+                added++
+            }
+            hash[args[i]] = args[i+1]
+        }
+        return added
+    case "EXPIRE":
+        if _, ok := f.hashes[args[0]]; !ok {
+            return 0
+        }
+        seconds, _ := strconv.Atoi(args[1])
+        f.expires[args[0]] = time.Now().Add(time.Duration(seconds) * time.Second)
+        return 1
+    case "PERSIST":
+        if _, ok := f.expires[args[0]]; !ok {
+            return 0
+        }
+        delete(f.expires, args[0])
+        return 1
+    case "PTTL":
+        if _, ok := f.hashes[args[0]]; !ok {
+            return -2
+        }
+        if at, ok := f.expires[args[0]]; ok {
+            return int(time.Until(at) / time.Millisecond)
+        }
+        return -1
+    case "SADD", "SREM":
+        set := f.sets[args[0]]
+        if set == nil {
+            set = make(map[string]bool)
+            f.sets[args[0]] = set
+        }
+        changed := 0
+        for _, member := range args[1:] {
+            if set[member] != (cmd == "SADD") {
+                set[member] = cmd == "SADD"
+                changed++
+            }
+            if !set[member] {
+                delete(set, member)
+            }
+        }
+        return changed
+    case "SMEMBERS":
+        members := []interface{}{}
+        for _, member := range f.members(args[0]) {
+            members = append(members, member)
+        }
+        return members
+    }
+    return fmt.Errorf("unknown command '%s'", cmd)
+}
+
+// members returns the sorted members of the set key
+func (f *fakeRedis) members(key string) []string {
+    var members []string
+    for member := range f.sets[key] {
+        members = append(members, member)
+    }
+    sort.Strings(members)
+    return members
+}
+
+// record returns the hash under the Redis key of cacheKey
+func (f *fakeRedis) record(cacheKey string) map[string]string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.hashes[prefix+cacheKey]
+}
+
+func (f *fakeRedis) setMembers(key string) []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.members(key)
+}
+
+func TestSaveRedisEntryCmCacheLayout(t *testing.T) {
+    f := useFakeRedis(t)
+    config := loadConfig()
+    config.CompressData = 0
+    config.CompressTags = 1
+    config.CompressThreshold = 1
+    config.CompressionLib = "gzip"
+    ctx := context.Background()
+
+    created := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+    entry := CacheEntry{
+        Content: "<html>page</html>",
+        Headers: map[string][]string{"Content-Type": {"text/html"}, "X-Multi": {"a", "b"}},
+        Created: created,
+    }
+    if err := saveRedisEntry(ctx, "PAGE", entry, []string{"cat_p_1", "cat_c_2"}, time.Hour); err != nil {
+        t.Fatal(err)
+    }
+
+    record := f.record("PAGE")
+    var page map[string]interface{}
+    if err := json.Unmarshal([]byte(record[cmFieldData]), &page); err != nil {
+        t.Fatalf("d is not the uncompressed page record: %v", err)
+    }
+    if page["content"] != entry.Content || page["status_code"] != float64(200) {
+        t.Errorf("d holds %v", page)
+    }
+    if headers := page["headers"].(map[string]interface{}); headers["Content-Type"] != "text/html" {
+        t.Errorf("single header value not kept as a string: %v", headers)
+    }
+    if !strings.HasPrefix(record[cmFieldTags], "gz"+cmCompressPrefix) {
+        t.Errorf("t %q is not compressed with COMPRESS_TAGS", record[cmFieldTags])
+    }
+    tags, err := decodeCmCacheData([]byte(record[cmFieldTags]))
+    if err != nil || string(tags) != "69d_CAT_P_1,69d_CAT_C_2,69d_FPC" {
+        t.Errorf("t decodes to %q (%v)", tags, err)
+    }
+    if record[cmFieldMtime] != strconv.FormatInt(created.Unix(), 10) || record[cmFieldInf] != "0" {
+        t.Errorf("m %q, i %q, want the creation time and 0", record[cmFieldMtime], record[cmFieldInf])
+    }
+    // The key expires an hour after the page was created
+    ttl := f.expires[prefix+"PAGE"].Sub(created)
+    if ttl < 59*time.Minute || ttl > time.Hour+time.Second {
+        t.Errorf("key expires %s after creation, want 1h", ttl)
+    }
+
+    for _, tag := range []string{"69d_CAT_P_1", "69d_CAT_C_2", "69d_FPC"} {
+        if got := f.setMembers(cmTagIdsPrefix + tag); len(got) != 1 || got[0] != "69d_PAGE" {
+            t.Errorf("%s%s = %v, want [69d_PAGE]", cmTagIdsPrefix, tag, got)
+        }
+    }
+    if got := f.setMembers(cmTagsSet); len(got) != 3 {
+        t.Errorf("%s = %v, want the 3 tag ids", cmTagsSet, got)
+    }
+
+    loaded, err := loadRedisEntry(ctx, "PAGE")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if loaded.Content != entry.Content || !loaded.Created.Equal(created) {
+        t.Errorf("loaded %q created %s, want %q created %s", loaded.Content, loaded.Created, entry.Content, created)
+    }
+    if strings.Join(loaded.Tags, ",") != "cat_p_1,cat_c_2" {
+        t.Errorf("loaded tags %v", loaded.Tags)
+    }
+}
+
+func TestSaveRedisEntryDropsOldTags(t *testing.T) {
+    f := useFakeRedis(t)
+    ctx := context.Background()
+    entry := CacheEntry{Content: "page", Created: time.Now()}
+
+    if err := saveRedisEntry(ctx, "PAGE", entry, []string{"cat_p_1", "cat_c_2"}, time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    if err := saveRedisEntry(ctx, "PAGE", entry, []string{"cat_p_1"}, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    if got := f.setMembers(cmTagIdsPrefix + "69d_CAT_C_2"); len(got) != 0 {
+        t.Errorf("old tag set still holds %v", got)
+    }
+    if got := f.setMembers(cmTagIdsPrefix + "69d_CAT_P_1"); len(got) != 1 {
+        t.Errorf("kept tag set holds %v, want the page", got)
+    }
+    record := f.record("PAGE")
+    if record[cmFieldInf] != "1" {
+        t.Errorf("i %q, want 1 for a page without lifetime", record[cmFieldInf])
+    }
+    if _, ok := f.expires[prefix+"PAGE"]; ok {
+        t.Error("page without lifetime still expires")
+    }
+}
+
+func TestSetCmCacheExpiry(t *testing.T) {
+    now := time.Now()
+    unix := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+    tests := []struct {
+        name     string
+        mtime    interface{}
+        inf      interface{}
+        ttl      time.Duration
+        age      time.Duration
+        lifetime time.Duration
+    }{
+        {"saved 10m ago, 30m left", unix(-10 * time.Minute), "0", 30 * time.Minute, 10 * time.Minute, 40 * time.Minute},
+        {"no mtime", nil, "0", 30 * time.Minute, 0, 30 * time.Minute},
+        {"mtime from the future", unix(time.Hour), "0", 30 * time.Minute, 0, 30 * time.Minute},
+        {"mtime not a number", "yesterday", "0", 30 * time.Minute, 0, 30 * time.Minute},
+        {"infinite flag", unix(-time.Minute), "1", 30 * time.Minute, time.Minute, 0},
+        {"key without expiry", unix(-time.Minute), "0", -1, time.Minute, 0},
+    }
+    for _, tt := range tests {
+        var entry CacheEntry
+        setCmCacheExpiry(&entry, tt.mtime, tt.inf, tt.ttl)
+        if age := entry.Age(time.Now()); age < tt.age-time.Second || age > tt.age+time.Second {
+            t.Errorf("%s: age %s, want %s", tt.name, age, tt.age)
+        }
+        if d := entry.Lifetime - tt.lifetime; d < -time.Second || d > time.Second {
+            t.Errorf("%s: lifetime %s, want %s", tt.name, entry.Lifetime, tt.lifetime)
+        }
+    }
+}
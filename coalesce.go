@@ -0,0 +1,171 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+var coalescer = newMissCoalescer()
+
+// errClientGone is returned to a follower whose client disconnected while it
+// waited; there is nobody left to answer
+var errClientGone = errors.New("client went away while waiting for the backend")
+
+// missFetch is one backend request other requests for the same key wait on
+type missFetch struct {
+    done  chan struct{}
+    entry *CacheEntry
+    err   error
+}
+
+// missCoalescer keeps a single backend request in flight per cache key
+type missCoalescer struct {
+    mu       sync.Mutex
+    inflight map[string]*missFetch
+
+    leaders      int64 // Backend requests made for a key
+    followers    int64 // Requests answered by another request's fetch
+    timeouts     int64 // Followers that gave up waiting on a slow fetch
+    uncacheable  int64 // Followers that fetched themselves because the response was private
+}
+
+// missCoalescerSnapshot is the JSON form of missCoalescer
+type missCoalescerSnapshot struct {
+    InFlight     int   `json:"in_flight"`
+    Leaders      int64 `json:"leaders"`
+    Followers    int64 `json:"followers"`
+    Timeouts     int64 `json:"timeouts"`
+    Uncacheable  int64 `json:"uncacheable"`
+}
+
+func newMissCoalescer() *missCoalescer {
+    return &missCoalescer{inflight: make(map[string]*missFetch)}
+}
+
+// join returns the fetch running for key and whether the caller leads it
+func (c *missCoalescer) join(key string) (*missFetch, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if f, ok := c.inflight[key]; ok {
+        return f, false
+    }
+    f := &missFetch{done: make(chan struct{})}
+    c.inflight[key] = f
+    return f, true
+}
+
+// takeOver replaces the slow fetch f for key with a new one led by the
+// caller, unless another follower already did; then the caller follows that
+func (c *missCoalescer) takeOver(key string, f *missFetch) (*missFetch, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if current, ok := c.inflight[key]; ok && current != f {
+        return current, false
+    }
+    next := &missFetch{done: make(chan struct{})}
+    c.inflight[key] = next
+    return next, true
+}
+
+// finish publishes the leader's result and lets the next miss start a new
+// fetch, unless a follower already took the key over
+func (c *missCoalescer) finish(key string, f *missFetch, entry *CacheEntry, err error) {
+    c.mu.Lock()
+    if c.inflight[key] == f {
+        delete(c.inflight, key)
+    }
+    c.mu.Unlock()
+    f.entry, f.err = entry, err
+    close(f.done)
+}
+
+// fetch proxies r for cacheKey and stores the response, unless a request for
+// the same key is already on its way to the backend; then it waits up to
+// COALESCE_TIMEOUT_MS for that response instead. The first follower to give
+// up takes the key over with a fetch of its own, which the others then wait
+// on. The leader's fetch is detached from its client, so one disconnect does
+// not fail everyone waiting. Responses that must not be stored are personal
+// and never handed to followers, failures are, so an outage is not multiplied
+// by the waiting requests.
+func (c *missCoalescer) fetch(w http.ResponseWriter, r *http.Request, cacheKey string, config *CacheConfig) (*CacheEntry, error) {
+    if !config.Coalesce {
+        return fetchAndStore(w, r, cacheKey, config)
+    }
+
+    f, leader := c.join(cacheKey)
+    if leader {
+        return c.lead(w, r, cacheKey, f, config)
+    }
+
+    timer := time.NewTimer(config.CoalesceTimeout)
+    defer timer.Stop()
+    for {
+        select {
+        case <-f.done:
+            // A failing backend is not asked again by every follower
+            if _, failed := backendFailure(f.entry, f.err); failed {
+                atomic.AddInt64(&c.followers, 1)
+                return f.shared(config), f.err
+            }
+            if f.entry.NoStore == "" {
+                atomic.AddInt64(&c.followers, 1)
+                return f.shared(config), nil
+            }
+            atomic.AddInt64(&c.uncacheable, 1)
+            return fetchAndStore(w, r, cacheKey, config)
+        case <-timer.C:
+            atomic.AddInt64(&c.timeouts, 1)
+            if f, leader = c.takeOver(cacheKey, f); leader {
+                return c.lead(w, r, cacheKey, f, config)
+            }
+            timer.Reset(config.CoalesceTimeout)
+        case <-r.Context().Done():
+            return nil, errClientGone
+        }
+    }
+}
+
+// lead fetches for everyone waiting on f
+func (c *missCoalescer) lead(w http.ResponseWriter, r *http.Request, cacheKey string, f *missFetch, config *CacheConfig) (*CacheEntry, error) {
+    atomic.AddInt64(&c.leaders, 1)
+    entry, err := fetchAndStore(w, r.WithContext(context.Background()), cacheKey, config)
+    c.finish(cacheKey, f, entry, err)
+    return entry, err
+}
+
+// shared is the leader's response as other clients may get it: without the
+// headers that are not cached, such as Set-Cookie
+func (f *missFetch) shared(config *CacheConfig) *CacheEntry {
+    if f.entry == nil {
+        return nil
+    }
+    entry := cachedCopy(*f.entry, config)
+    return &entry
+}
+
+// fetchAndStore proxies r and keeps the response under cacheKey when it may be stored
+func fetchAndStore(w http.ResponseWriter, r *http.Request, cacheKey string, config *CacheConfig) (*CacheEntry, error) {
+    entry, err := proxyRequest(w, r)
+    if err != nil {
+        return nil, err
+    }
+    storeEntry(cacheKey, *entry, config)
+    return entry, nil
+}
+
+func (c *missCoalescer) snapshot() missCoalescerSnapshot {
+    c.mu.Lock()
+    inflight := len(c.inflight)
+    c.mu.Unlock()
+    return missCoalescerSnapshot{
+        InFlight:     inflight,
+        Leaders:      atomic.LoadInt64(&c.leaders),
+        Followers:    atomic.LoadInt64(&c.followers),
+        Timeouts:     atomic.LoadInt64(&c.timeouts),
+        Uncacheable:  atomic.LoadInt64(&c.uncacheable),
+    }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// useCoalescer gives the test its own coalescer with the given timeout
+func useCoalescer(t *testing.T, timeout time.Duration) *missCoalescer {
+    t.Helper()
+    config := loadConfig()
+    saved, savedCoalescer := *config, coalescer
+    config.Coalesce = true
+    config.CoalesceTimeout = timeout
+    coalescer = newMissCoalescer()
+    t.Cleanup(func() {
+        *config = saved
+        coalescer = savedCoalescer
+    })
+    return coalescer
+}
+
+// getPages requests path n times concurrently
+func getPages(path string, n int) []*httptest.ResponseRecorder {
+    recs := make([]*httptest.ResponseRecorder, n)
+    var wg sync.WaitGroup
+    for i := range recs {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            recs[i] = getPage(path)
+        }(i)
+    }
+    wg.Wait()
+    return recs
+}
+
+func TestCoalescedMissesShareOneFetch(t *testing.T) {
+    started, release := make(chan struct{}, 10), make(chan struct{})
+    calls := useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        started <- struct{}{}
+        <-release
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Write([]byte("page"))
+    })
+    c := useCoalescer(t, time.Minute)
+
+    leader := make(chan *httptest.ResponseRecorder)
+    go func() { leader <- getPage("/coalesce-shared") }()
+    <-started
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        close(release)
+    }()
+    recs := append(getPages("/coalesce-shared", 3), <-leader)
+
+    for i, rec := range recs {
+        if rec.Code != http.StatusOK || rec.Body.String() != "page" {
+            t.Errorf("request %d: %d %q, want the shared page", i, rec.Code, rec.Body.String())
+        }
+    }
+    if got := atomic.LoadInt64(calls); got != 1 {
+        t.Errorf("backend called %d times, want 1", got)
+    }
+    if snap := c.snapshot(); snap.Leaders != 1 || snap.InFlight != 0 {
+        t.Errorf("leaders %d, in flight %d, want 1 and 0", snap.Leaders, snap.InFlight)
+    }
+}
+
+func TestCoalesceTimeoutTakesOverOnce(t *testing.T) {
+    release := make(chan struct{})
+    started := make(chan struct{}, 10)
+    var n int64
+    calls := useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        if atomic.AddInt64(&n, 1) == 1 {
+            started <- struct{}{}
+            <-release
+        } else {
+            time.Sleep(30 * time.Millisecond)
+        }
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Write([]byte("page"))
+    })
+    c := useCoalescer(t, 100*time.Millisecond)
+
+    leader := make(chan *httptest.ResponseRecorder)
+    go func() { leader <- getPage("/coalesce-slow") }()
+    <-started
+    recs := getPages("/coalesce-slow", 4)
+    close(release)
+    <-leader
+
+    for i, rec := range recs {
+        if rec.Code != http.StatusOK || rec.Body.String() != "page" {
+            t.Errorf("follower %d: %d %q, want the page", i, rec.Code, rec.Body.String())
+        }
+    }
+    // The stuck leader and the one follower that took over
+    if got := atomic.LoadInt64(calls); got != 2 {
+        t.Errorf("backend called %d times, want 2", got)
+    }
+    if snap := c.snapshot(); snap.Leaders != 2 || snap.Timeouts != 4 {
+        t.Errorf("leaders %d, timeouts %d, want 2 and 4", snap.Leaders, snap.Timeouts)
+    }
+}
+
+func TestCoalescedUncacheableResponseIsNotShared(t *testing.T) {
+    started, release := make(chan struct{}, 10), make(chan struct{})
+    var n int64
+    calls := useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        call := atomic.AddInt64(&n, 1)
+        if call == 1 {
+            started <- struct{}{}
+            <-release
+        }
+        w.Header().Set("Cache-Control", "private, max-age=60")
+        w.Header().Set("Set-Cookie", "session="+strconv.FormatInt(call, 10))
+        w.Write([]byte("private page"))
+    })
+    useCoalescer(t, time.Minute)
+
+    leader := make(chan *httptest.ResponseRecorder)
+    go func() { leader <- getPage("/coalesce-private") }()
+    <-started
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        close(release)
+    }()
+    recs := append(getPages("/coalesce-private", 3), <-leader)
+
+    // Every client gets a response of its own, with its own cookie
+    seen := map[string]bool{}
+    for i, rec := range recs {
+        cookie := rec.Header().Get("Set-Cookie")
+        if rec.Code != http.StatusOK || cookie == "" || seen[cookie] {
+            t.Errorf("request %d: %d with Set-Cookie %q, want a cookie of its own", i, rec.Code, cookie)
+        }
+        seen[cookie] = true
+    }
+    if got := atomic.LoadInt64(calls); got != 4 {
+        t.Errorf("backend called %d times, want 4", got)
+    }
+}
+
+func TestCoalescedFollowerLeavesQuietly(t *testing.T) {
+    started, release := make(chan struct{}, 10), make(chan struct{})
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        started <- struct{}{}
+        <-release
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Write([]byte("page"))
+    })
+    useCoalescer(t, time.Minute)
+
+    leader := make(chan *httptest.ResponseRecorder)
+    go func() { leader <- getPage("/coalesce-gone") }()
+    <-started
+    defer func() {
+        close(release)
+        <-leader
+    }()
+
+    missed := atomic.LoadInt64(&graceStats.missed)
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    rec := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodGet, "http://shop.example/coalesce-gone", nil)
+    handleRequest(rec, req.WithContext(ctx))
+
+    if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+        t.Errorf("left client got %d %q, want nothing written", rec.Code, rec.Body.String())
+    }
+    if got := atomic.LoadInt64(&graceStats.missed); got != missed {
+        t.Errorf("grace misses went from %d to %d, want no backend failure counted", missed, got)
+    }
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+    "bytes"
+    "compress/zlib"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+
+    "github.com/klauspost/compress/snappy"
+    "github.com/klauspost/compress/zstd"
+    "github.com/pierrec/lz4/v4"
+)
+
+// Upper bound for a decompressed payload, so a corrupt size header cannot
+// make us allocate gigabytes
+const cmMaxDecodedSize = 256 << 20
+
+// Neither an LZ4 nor a Snappy block expands more than 255 times, so a larger
+// size header is corrupt and is rejected before allocating for it
+const cmMaxBlockRatio = 255
+
+// cmCodec is one Cm_Cache compression_lib. Payloads are marked with the first
+// two letters of the library name (substr($lib, 0, 2)) followed by cmCompressPrefix.
+type cmCodec struct {
+    name   string
+    decode func(data []byte) ([]byte, error)
+    encode func(data []byte, level int) ([]byte, error)
+}
+
+var (
+    cmCodecs = map[string]*cmCodec{} // Payload prefix → codec
+
+    cmDecodeErrorsMu sync.Mutex
+    cmDecodeErrors   = map[string]int64{} // Payload prefix → failed decodes
+
+    zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(cmMaxDecodedSize))
+)
+
+func init() {
+    gzip := &cmCodec{name: "gzip", decode: decodeZlib, encode: encodeZlib}
+    registerCmCodec("gz", gzip)
+    registerCmCodec("zc", gzip) // Prefix of the old zlib library name
+    registerCmCodec("sn", &cmCodec{name: "snappy", decode: decodeSnappy, encode: encodeSnappy})
+    registerCmCodec("lz", &cmCodec{name: "lzf", decode: decodeLZF})
+    registerCmCodec("l4", &cmCodec{name: "l4z", decode: decodeLZ4, encode: encodeLZ4})
+    registerCmCodec("zs", &cmCodec{name: "zstd", decode: decodeZstd, encode: encodeZstd})
+}
+
+// registerCmCodec makes a compression library available for reading and,
+// when it has an encoder, for COMPRESSION_LIB
+func registerCmCodec(prefix string, codec *cmCodec) {
+    cmCodecs[prefix] = codec
+}
+
+// cmCodecFor returns the codec and payload prefix for a compression_lib name.
+// Libraries we can only read fall back to gzip, which every PHP build can decode.
+func cmCodecFor(lib string) (string, *cmCodec) {
+    if len(lib) >= 2 {
+        if codec, ok := cmCodecs[lib[:2]]; ok && codec.encode != nil {
+            return lib[:2], codec
+        }
+    }
+    return "gz", cmCodecs["gz"]
+}
+
+// checkCompressionLib warns when COMPRESSION_LIB cannot be used for writing
+func checkCompressionLib(lib string) {
+    if prefix, codec := cmCodecFor(lib); !strings.HasPrefix(lib, prefix) {
+        warnLog("Warning: COMPRESSION_LIB %q cannot be written, Redis write-through uses %s\n", lib, codec.name)
+    }
+}
+
+// cmDecodeError is returned when a payload carries a known envelope but its
+// body cannot be decompressed
+type cmDecodeError struct {
+    Prefix string
+    Lib    string
+    Err    error
+}
+
+func (e *cmDecodeError) Error() string {
+    if e.Lib == "" {
+        return fmt.Sprintf("cm_cache: unknown compression library %q", e.Prefix)
+    }
+    return fmt.Sprintf("cm_cache: cannot decode %s payload: %v", e.Lib, e.Err)
+}
+
+func (e *cmDecodeError) Unwrap() error {
+    return e.Err
+}
+
+// decodeWith runs the codec registered for prefix and counts failures
+func decodeWith(prefix string, data []byte) ([]byte, error) {
+    codec, ok := cmCodecs[prefix]
+    if !ok {
+        countDecodeError(prefix)
+        return nil, &cmDecodeError{Prefix: prefix}
+    }
+    decoded, err := codec.decode(data)
+    if err != nil {
+        countDecodeError(prefix)
+        return nil, &cmDecodeError{Prefix: prefix, Lib: codec.name, Err: err}
+    }
+    return decoded, nil
+}
+
+func countDecodeError(prefix string) {
+    cmDecodeErrorsMu.Lock()
+    cmDecodeErrors[prefix]++
+    cmDecodeErrorsMu.Unlock()
+}
+
+// decodeErrorStats returns the failed decodes per library for /cache/stats
+func decodeErrorStats() map[string]int64 {
+    cmDecodeErrorsMu.Lock()
+    defer cmDecodeErrorsMu.Unlock()
+    stats := make(map[string]int64, len(cmDecodeErrors))
+    for prefix, count := range cmDecodeErrors {
+        if codec, ok := cmCodecs[prefix]; ok {
+            prefix = codec.name
+        }
+        stats[prefix] += count
+    }
+    return stats
+}
+
+// PHP gzcompress()/gzuncompress() use a zlib stream
+func decodeZlib(data []byte) ([]byte, error) {
+    return readAllFrom(zlib.NewReader(bytes.NewReader(data)))
+}
+
+func encodeZlib(data []byte, level int) ([]byte, error) {
+    if level > zlib.BestCompression {
+        level = zlib.BestCompression
+    }
+    var b bytes.Buffer
+    writer, err := zlib.NewWriterLevel(&b, level)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := writer.Write(data); err != nil {
+        return nil, err
+    }
+    if err := writer.Close(); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+// php-snappy writes the raw block format, not the framed stream
+func decodeSnappy(data []byte) ([]byte, error) {
+    size, err := snappy.DecodedLen(data)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkDecodedSize(uint64(size), len(data)); err != nil {
+        return nil, err
+    }
+    return snappy.Decode(nil, data)
+}
+
+func encodeSnappy(data []byte, _ int) ([]byte, error) {
+    return snappy.Encode(nil, data), nil
+}
+
+// php-ext-lz4 prepends the uncompressed size as a 4 byte little endian
+// integer to a raw LZ4 block
+func decodeLZ4(data []byte) ([]byte, error) {
+    if len(data) < 4 {
+        return nil, errors.New("missing size header")
+    }
+    size := binary.LittleEndian.Uint32(data)
+    if err := checkDecodedSize(uint64(size), len(data)-4); err != nil {
+        return nil, err
+    }
+    out := make([]byte, size)
+    n, err := lz4.UncompressBlock(data[4:], out)
+    if err != nil {
+        return nil, err
+    }
+    if n != int(size) {
+        return nil, fmt.Errorf("decoded %d bytes, header says %d", n, size)
+    }
+    return out, nil
+}
+
+// checkDecodedSize validates the size header of a compressed block
+func checkDecodedSize(size uint64, compressed int) error {
+    if size > cmMaxDecodedSize {
+        return fmt.Errorf("decoded size %d exceeds limit", size)
+    }
+    if size > uint64(compressed)*cmMaxBlockRatio {
+        return fmt.Errorf("decoded size %d is impossible for %d compressed bytes", size, compressed)
+    }
+    return nil
+}
+
+func encodeLZ4(data []byte, level int) ([]byte, error) {
+    out := make([]byte, 4+lz4.CompressBlockBound(len(data)))
+    binary.LittleEndian.PutUint32(out, uint32(len(data)))
+
+    var n int
+    var err error
+    if level > 0 {
+        if level > 9 {
+            level = 9
+        }
+        // lz4.Level1..Level9 are 1<<9..1<<17
+        n, err = lz4.CompressBlockHC(data, out[4:], lz4.CompressionLevel(1<<(8+level)), nil, nil)
+    } else {
+        n, err = lz4.CompressBlock(data, out[4:], nil)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if n == 0 {
+        return nil, errors.New("data is not compressible")
+    }
+    return out[:4+n], nil
+}
+
+// php-ext-zstd writes a regular zstd frame
+func decodeZstd(data []byte) ([]byte, error) {
+    if len(data) == 0 {
+        return nil, errors.New("missing frame")
+    }
+    return zstdDecoder.DecodeAll(data, nil)
+}
+
+func encodeZstd(data []byte, level int) ([]byte, error) {
+    encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+    if err != nil {
+        return nil, err
+    }
+    defer encoder.Close()
+    return encoder.EncodeAll(data, nil), nil
+}
+
+// decodeLZF decompresses a LibLZF block as written by php-lzf. LZF has no
+// header, so the output simply grows until the input is consumed.
+func decodeLZF(data []byte) ([]byte, error) {
+    out := make([]byte, 0, len(data)*3)
+    for ip := 0; ip < len(data); {
+        ctrl := int(data[ip])
+        ip++
+
+        if ctrl < 1<<5 {
+            // Literal run of ctrl+1 bytes
+            length := ctrl + 1
+            if ip+length > len(data) {
+                return nil, errors.New("lzf: literal run past end of input")
+            }
+            out = append(out, data[ip:ip+length]...)
+            ip += length
+            continue
+        }
+
+        // Back reference
+        length := ctrl >> 5
+        if length == 7 {
+            if ip >= len(data) {
+                return nil, errors.New("lzf: truncated back reference")
+            }
+            length += int(data[ip])
+            ip++
+        }
+        length += 2
+        if ip >= len(data) {
+            return nil, errors.New("lzf: truncated back reference")
+        }
+        ref := len(out) - (ctrl&0x1f)<<8 - 1 - int(data[ip])
+        ip++
+        if ref < 0 {
+            return nil, errors.New("lzf: back reference before start of output")
+        }
+        if len(out)+length > cmMaxDecodedSize {
+            return nil, errors.New("lzf: decoded size exceeds limit")
+        }
+        // Copy byte by byte, the reference may overlap the bytes being written
+        for i := 0; i < length; i++ {
+            out = append(out, out[ref+i])
+        }
+    }
+    return out, nil
+}
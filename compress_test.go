@@ -0,0 +1,140 @@
+package main
+
+import (
+    "bytes"
+    "encoding/hex"
+    "errors"
+    "runtime"
+    "strings"
+    "testing"
+)
+
+// cmPayload wraps a compressed body in the Cm_Cache envelope for prefix
+func cmPayload(prefix string, body []byte) []byte {
+    return append([]byte(prefix+cmCompressPrefix), body...)
+}
+
+func mustHex(t *testing.T, s string) []byte {
+    t.Helper()
+    b, err := hex.DecodeString(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+// cmVectors are payloads as the PHP extensions write them
+var cmVectors = []struct {
+    prefix string
+    body   string
+    want   string
+}{
+    {"gz", "789ccb48cdc9c90700062c0215", "hello"},
+    {"zc", "789ccb48cdc9c90700062c0215", "hello"},
+    {"sn", "051068656c6c6f", "hello"},
+    {"lz", "0468656c6c6f", "hello"},
+    {"lz", "0061e00000", "aaaaaaaaaa"},
+    {"lz", "026162638002", "abcabcabc"},
+    {"l4", "050000005068656c6c6f", "hello"},
+    {"zs", "28b52ffd200529000068656c6c6f", "hello"},
+}
+
+func TestCmCodecKnownVectors(t *testing.T) {
+    for _, v := range cmVectors {
+        got, err := decodeCmCacheData(cmPayload(v.prefix, mustHex(t, v.body)))
+        if err != nil {
+            t.Errorf("%s %s: %v", v.prefix, v.body, err)
+            continue
+        }
+        if string(got) != v.want {
+            t.Errorf("%s %s: got %q, want %q", v.prefix, v.body, got, v.want)
+        }
+    }
+}
+
+func TestCmCodecRoundTrip(t *testing.T) {
+    page := []byte(strings.Repeat("<div class=\"product-item\"><a href=\"/p.html\">Product</a></div>\n", 500))
+    for prefix, codec := range cmCodecs {
+        if codec.encode == nil {
+            continue
+        }
+        for _, level := range []int{1, 6, 9} {
+            encoded, err := codec.encode(page, level)
+            if err != nil {
+                t.Errorf("%s level %d: encode: %v", prefix, level, err)
+                continue
+            }
+            decoded, err := decodeCmCacheData(cmPayload(prefix, encoded))
+            if err != nil {
+                t.Errorf("%s level %d: decode: %v", prefix, level, err)
+                continue
+            }
+            if !bytes.Equal(decoded, page) {
+                t.Errorf("%s level %d: round trip changed the page", prefix, level)
+            }
+        }
+    }
+}
+
+func TestCmCodecRejectsTruncatedInput(t *testing.T) {
+    for _, v := range cmVectors {
+        if v.prefix == "lz" {
+            continue // LZF has no length, a cut between instructions is a valid block
+        }
+        body := mustHex(t, v.body)
+        for n := 0; n < len(body); n++ {
+            if got, err := decodeCmCacheData(cmPayload(v.prefix, body[:n])); err == nil {
+                t.Errorf("%s cut to %d bytes: decoded %q without error", v.prefix, n, got)
+            }
+        }
+    }
+}
+
+func TestCmCodecRejectsCorruptInput(t *testing.T) {
+    tests := []struct {
+        name   string
+        prefix string
+        body   string
+    }{
+        {"zlib bad checksum", "gz", "789ccb48cdc9c90700062c0216"},
+        {"zlib not a stream", "gz", "68656c6c6f"},
+        {"snappy length mismatch", "sn", "061068656c6c6f"},
+        {"snappy huge length", "sn", "8080806410"},
+        {"lzf literal past end", "lz", "0568656c6c6f"},
+        {"lzf reference before start", "lz", "2000"},
+        {"lzf truncated reference", "lz", "0061e0"},
+        {"lz4 size mismatch", "l4", "060000005068656c6c6f"},
+        {"lz4 size at limit", "l4", "000000105068656c6c6f"},
+        {"lz4 size over limit", "l4", "ffffffff5068656c6c6f"},
+        {"zstd bad magic", "zs", "28b52ffe200529000068656c6c6f"},
+        {"unknown library", "xx", "68656c6c6f"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := decodeCmCacheData(cmPayload(tt.prefix, mustHex(t, tt.body)))
+            if err == nil {
+                t.Fatalf("decoded %q without error", got)
+            }
+            var decodeErr *cmDecodeError
+            if !errors.As(err, &decodeErr) || decodeErr.Prefix != tt.prefix {
+                t.Errorf("error %v is not a cmDecodeError for %s", err, tt.prefix)
+            }
+        })
+    }
+}
+
+// A size header is checked against the block before anything is allocated
+func TestCmCodecSizeHeaderDoesNotAllocate(t *testing.T) {
+    for _, payload := range [][]byte{
+        cmPayload("l4", mustHex(t, "000000105068656c6c6f")),
+        cmPayload("sn", mustHex(t, "8080806410")),
+    } {
+        var before, after runtime.MemStats
+        runtime.ReadMemStats(&before)
+        decodeCmCacheData(payload)
+        runtime.ReadMemStats(&after)
+        if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+            t.Errorf("%q allocated %d bytes", payload[:2], allocated)
+        }
+    }
+}
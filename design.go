@@ -0,0 +1,131 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "regexp"
+    "strings"
+)
+
+// designException is one row of design/theme/ua_regexp: a User-Agent pattern
+// and the theme Magento renders for it
+type designException struct {
+    Pattern *regexp.Regexp
+    Theme   string
+}
+
+// parseDesignExceptions reads DESIGN_EXCEPTIONS, the JSON value Magento keeps
+// in core_config_data for design/theme/ua_regexp. Rows are kept in the saved
+// order since the first match wins.
+func parseDesignExceptions(spec string) []designException {
+    spec = strings.TrimSpace(spec)
+    if spec == "" {
+        return nil
+    }
+    rows, err := decodeOrderedRows([]byte(spec))
+    if err != nil {
+        warnLog("Warning: ignoring DESIGN_EXCEPTIONS: %v\n", err)
+        return nil
+    }
+
+    var rules []designException
+    for _, row := range rows {
+        var rule struct {
+            Regexp string      `json:"regexp"`
+            Value  interface{} `json:"value"`
+        }
+        if err := json.Unmarshal(row, &rule); err != nil {
+            warnLog("Warning: ignoring design exception %s: %v\n", row, err)
+            continue
+        }
+        pattern, err := compilePCRE(rule.Regexp)
+        if err != nil {
+            warnLog("Warning: design exception %q cannot be matched, its pages will be keyed without a theme: %v\n", rule.Regexp, err)
+            continue
+        }
+        rules = append(rules, designException{Pattern: pattern, Theme: phpString(rule.Value)})
+    }
+    return rules
+}
+
+// decodeOrderedRows returns the values of a JSON array, or of a JSON object
+// in key order as PHP's json_decode keeps them
+func decodeOrderedRows(raw []byte) ([]json.RawMessage, error) {
+    raw = bytes.TrimSpace(raw)
+    if len(raw) > 0 && raw[0] == '[' {
+        var rows []json.RawMessage
+        err := json.Unmarshal(raw, &rows)
+        return rows, err
+    }
+
+    dec := json.NewDecoder(bytes.NewReader(raw))
+    if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+        return nil, fmt.Errorf("expected a JSON object or array")
+    }
+    var rows []json.RawMessage
+    for dec.More() {
+        if _, err := dec.Token(); err != nil {
+            return nil, err
+        }
+        var row json.RawMessage
+        if err := dec.Decode(&row); err != nil {
+            return nil, err
+        }
+        rows = append(rows, row)
+    }
+    return rows, nil
+}
+
+// compilePCRE translates a delimited PHP preg pattern such as "/iPhone/i"
+// into a Go regexp. Only modifiers RE2 has an equivalent for are accepted.
+func compilePCRE(pattern string) (*regexp.Regexp, error) {
+    if len(pattern) < 2 {
+        return nil, fmt.Errorf("empty pattern")
+    }
+    open := pattern[0]
+    end := map[byte]byte{'(': ')', '{': '}', '[': ']', '<': '>'}[open]
+    if end == 0 {
+        end = open
+    }
+    i := strings.LastIndexByte(pattern, end)
+    if i <= 0 {
+        return nil, fmt.Errorf("no ending delimiter %q", end)
+    }
+    expr, modifiers := pattern[1:i], pattern[i+1:]
+
+    var flags string
+    for _, m := range modifiers {
+        switch m {
+        case 'i', 'm', 's':
+            flags += string(m)
+        case 'U':
+            flags += "U"
+        case 'u', 'D', ' ', '\n', '\r':
+            // RE2 always matches UTF-8 and its $ never matches before a final
+            // newline; PHP skips whitespace between modifiers
+        default:
+            return nil, fmt.Errorf("unsupported modifier %q", m)
+        }
+    }
+    if flags != "" {
+        expr = "(?" + flags + ")" + expr
+    }
+    return regexp.Compile(expr)
+}
+
+// designTheme mirrors DesignExceptions::getThemeByRequest: the theme of the
+// first rule matching the User-Agent, false when none does
+func designTheme(r *http.Request, config *CacheConfig) (string, bool) {
+    userAgent := r.Header.Get("User-Agent")
+    if userAgent == "" {
+        return "", false
+    }
+    for _, rule := range config.DesignExceptions {
+        if rule.Pattern.MatchString(userAgent) {
+            return rule.Theme, true
+        }
+    }
+    return "", false
+}
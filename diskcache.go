@@ -0,0 +1,684 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Page files start with diskMagic, a format version, the CRC-32C of the
+// payload and its length. The payload is the JSON of a diskPage in the
+// Cm_Cache compression envelope of COMPRESSION_LIB.
+const (
+    diskMagic      = "FPCD"
+    diskVersion    = 1
+    diskHeaderSize = len(diskMagic) + 1 + 4 + 4
+    diskPageExt    = ".page"
+    diskTmpDir     = "tmp"
+)
+
+// Temporary files older than this are left over from a crash
+const diskTmpMaxAge = 10 * time.Minute
+
+var (
+    // diskCache is the optional tier between memory and Redis, nil when
+    // DISK_CACHE_DIR is not set
+    diskCache *diskStore
+
+    crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+    errDiskCorrupt = errors.New("disk cache: corrupt page file")
+)
+
+// diskPage is what a page file holds
+type diskPage struct {
+    Key    string     `json:"key"`
+    Stored time.Time  `json:"stored"` // When the page entered the local cache
+    Entry  CacheEntry `json:"entry"`
+}
+
+// diskRecord is the in-memory index entry of one page file
+type diskRecord struct {
+    key     string
+    tags    []string
+    size    int64 // File size, the page size while the write is queued
+    stored  time.Time
+    expires time.Time // Past this the page cannot even be served as a grace copy
+    access  time.Time
+    written bool
+}
+
+// diskWrite is a page queued for the writer
+type diskWrite struct {
+    name string
+    rec  *diskRecord
+    page diskPage
+}
+
+// diskStore keeps one file per page under DISK_CACHE_DIR/xx/<sha1 of key>.page.
+// Files are written to DISK_CACHE_DIR/tmp, synced and renamed into place, so a
+// crash leaves either the old page or the new one. A single writer takes pages
+// from a bounded queue; the index in memory lets purges find pages by tag and
+// keeps the directory within DISK_MAX_MB.
+type diskStore struct {
+    dir      string
+    maxBytes int64
+    config   *CacheConfig
+    queue    chan diskWrite
+
+    mu      sync.Mutex
+    index   map[string]*diskRecord // File name → record
+    bytes   int64
+    indexed bool // warm has indexed every file, so the index knows all pages
+
+    hits, misses, writes, writeErrors, dropped, corrupt, evictions, expired int64
+    compactions, reclaimed, warmed                                          int64
+}
+
+// diskSnapshot is the JSON form of diskStore statistics
+type diskSnapshot struct {
+    Dir         string `json:"dir"`
+    Entries     int    `json:"entries"`
+    Bytes       int64  `json:"bytes"`
+    MaxBytes    int64  `json:"max_bytes"`
+    QueueDepth  int    `json:"queue_depth"`
+    Hits        int64  `json:"hits"`
+    Misses      int64  `json:"misses"`
+    Writes      int64  `json:"writes"`
+    WriteErrors int64  `json:"write_errors"`
+    Dropped     int64  `json:"dropped"`
+    Corrupt     int64  `json:"corrupt"`
+    Evictions   int64  `json:"evictions"`
+    Expired     int64  `json:"expired"`
+    Compactions int64  `json:"compactions"`
+    Reclaimed   int64  `json:"reclaimed_bytes"`
+    Warmed      int64  `json:"warmed"`
+}
+
+// initDisk opens DISK_CACHE_DIR, starts the writer and, in the background,
+// indexes the pages already there, warms the memory tier with the newest of
+// them and then compacts the directory every DISK_COMPACT_INTERVAL
+func initDisk(config *CacheConfig) {
+    if config.DiskDir == "" || !config.UseCache {
+        return
+    }
+    if err := os.MkdirAll(filepath.Join(config.DiskDir, diskTmpDir), 0o755); err != nil {
+        errorLog("Disk cache disabled: %v\n", err)
+        return
+    }
+
+    d := &diskStore{
+        dir:      config.DiskDir,
+        maxBytes: config.DiskMaxBytes,
+        config:   config,
+        queue:    make(chan diskWrite, config.DiskWriteQueue),
+        index:    make(map[string]*diskRecord),
+    }
+    diskCache = d
+    go d.writer()
+    go func() {
+        d.warm()
+        if config.DiskCompactInterval <= 0 {
+            return
+        }
+        for range time.Tick(config.DiskCompactInterval) {
+            d.compact()
+        }
+    }()
+}
+
+// diskName is the file name of key; keys can contain "/" from design themes
+func diskName(key string) string {
+    sum := sha1.Sum([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+func (d *diskStore) path(name string) string {
+    return filepath.Join(d.dir, name[:2], name+diskPageExt)
+}
+
+// expiresAt is when a page stored at stored can no longer be served, fresh
+// or stale like the local tier would keep it, or as a grace copy
+func (d *diskStore) expiresAt(entry CacheEntry, stored time.Time) time.Time {
+    window := d.config.CacheTTL
+    if d.config.UseStale {
+        window += d.config.StaleExpiry
+    }
+    expires := stored.Add(window)
+    if origin := entry.ExpiresAt(); !origin.IsZero() && origin.Before(expires) {
+        expires = origin
+    }
+    if grace := stored.Add(d.config.GraceTTL); grace.After(expires) {
+        expires = grace
+    }
+    return expires
+}
+
+// save queues entry to be written under key. A full queue drops the write,
+// the previous file for key stays in place.
+func (d *diskStore) save(key string, entry CacheEntry) {
+    if d == nil {
+        return
+    }
+    entry.Expired = false
+    now := time.Now()
+    name := diskName(key)
+    rec := &diskRecord{
+        key:     key,
+        tags:    entry.Tags,
+        size:    int64(len(entry.Content)),
+        stored:  now,
+        expires: d.expiresAt(entry, now),
+        access:  now,
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    select {
+    case d.queue <- diskWrite{name: name, rec: rec, page: diskPage{Key: key, Stored: now, Entry: entry}}:
+        if old, ok := d.index[name]; ok {
+            d.bytes -= old.size
+        }
+        d.index[name] = rec
+        d.bytes += rec.size
+    default:
+        atomic.AddInt64(&d.dropped, 1)
+    }
+}
+
+// writer writes queued pages one at a time. A page purged while it waited is
+// not written: its record is no longer the one in the index.
+func (d *diskStore) writer() {
+    for job := range d.queue {
+        tmp, size, err := d.writeTmp(job)
+        if err != nil {
+            atomic.AddInt64(&d.writeErrors, 1)
+            errorLog("Disk cache write of %s failed: %v\n", job.page.Key, err)
+            d.mu.Lock()
+            if d.index[job.name] == job.rec {
+                d.removeLocked(job.name, job.rec)
+            }
+            d.mu.Unlock()
+            continue
+        }
+
+        d.mu.Lock()
+        if d.index[job.name] != job.rec {
+            d.mu.Unlock()
+            os.Remove(tmp)
+            continue
+        }
+        final := d.path(job.name)
+        if err := os.Rename(tmp, final); err != nil {
+            atomic.AddInt64(&d.writeErrors, 1)
+            errorLog("Disk cache write of %s failed: %v\n", job.page.Key, err)
+            os.Remove(tmp)
+            d.removeLocked(job.name, job.rec)
+            d.mu.Unlock()
+            continue
+        }
+        d.bytes += size - job.rec.size
+        job.rec.size = size
+        job.rec.written = true
+        d.evictLocked()
+        d.mu.Unlock()
+
+        syncDir(filepath.Dir(final))
+        atomic.AddInt64(&d.writes, 1)
+    }
+}
+
+// writeTmp writes and syncs the page file for job in the tmp directory
+func (d *diskStore) writeTmp(job diskWrite) (string, int64, error) {
+    data, err := encodeDiskPage(job.page, d.config.CompressData)
+    if err != nil {
+        return "", 0, err
+    }
+    if err := os.MkdirAll(filepath.Dir(d.path(job.name)), 0o755); err != nil {
+        return "", 0, err
+    }
+    f, err := os.CreateTemp(filepath.Join(d.dir, diskTmpDir), job.name+"-*")
+    if err != nil {
+        return "", 0, err
+    }
+    if _, err = f.Write(data); err == nil {
+        err = f.Sync()
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(f.Name())
+        return "", 0, err
+    }
+    return f.Name(), int64(len(data)), nil
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) {
+    if f, err := os.Open(dir); err == nil {
+        f.Sync()
+        f.Close()
+    }
+}
+
+// load returns the page of key from disk and puts it back in the memory tier,
+// fresh or stale depending on when it was stored
+func (d *diskStore) load(key string) (CacheEntry, bool) {
+    if d == nil {
+        return CacheEntry{}, false
+    }
+    name := diskName(key)
+    if !d.mayHave(name) {
+        atomic.AddInt64(&d.misses, 1)
+        return CacheEntry{}, false
+    }
+    page, err := d.read(name)
+    if err != nil || page.Key != key {
+        atomic.AddInt64(&d.misses, 1)
+        return CacheEntry{}, false
+    }
+
+    // A purge may have removed the file while it was read
+    d.mu.Lock()
+    rec, ok := d.index[name]
+    if !ok {
+        info, statErr := os.Stat(d.path(name))
+        if statErr != nil {
+            d.mu.Unlock()
+            atomic.AddInt64(&d.misses, 1)
+            return CacheEntry{}, false
+        }
+        rec = d.indexLocked(name, page, info.Size())
+    }
+    rec.access = time.Now()
+    d.mu.Unlock()
+
+    entry, ok := d.restore(page)
+    if !ok {
+        atomic.AddInt64(&d.misses, 1)
+        return CacheEntry{}, false
+    }
+    atomic.AddInt64(&d.hits, 1)
+    return entry, true
+}
+
+// graceCopy returns the page of key when it was stored within GRACE_TTL,
+// marked expired and without putting it back in the memory tier
+func (d *diskStore) graceCopy(key string) (CacheEntry, bool) {
+    if d == nil || d.config.GraceTTL <= 0 {
+        return CacheEntry{}, false
+    }
+    name := diskName(key)
+    if !d.mayHave(name) {
+        return CacheEntry{}, false
+    }
+    page, err := d.read(name)
+    if err != nil || page.Key != key || time.Since(page.Stored) >= d.config.GraceTTL {
+        return CacheEntry{}, false
+    }
+    entry := page.Entry
+    entry.Expired = true
+    return entry, true
+}
+
+// mayHave reports whether the page file name can exist: once warm has indexed
+// the directory a page the index does not know is a miss without touching it
+func (d *diskStore) mayHave(name string) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    _, ok := d.index[name]
+    return ok || !d.indexed
+}
+
+// read decodes the page file name, removing it when it is corrupt
+func (d *diskStore) read(name string) (diskPage, error) {
+    data, err := os.ReadFile(d.path(name))
+    if err != nil {
+        return diskPage{}, err
+    }
+    page, err := decodeDiskPage(data)
+    if err != nil {
+        atomic.AddInt64(&d.corrupt, 1)
+        errorLog("Disk cache file %s removed: %v\n", d.path(name), err)
+        d.delete(name)
+    }
+    return page, err
+}
+
+// restore puts page in the memory tier with the lifetime it has left:
+// fresh within CACHE_TTL of being stored, stale within STALE_TTL after that
+func (d *diskStore) restore(page diskPage) (CacheEntry, bool) {
+    entry := page.Entry
+    entry.Expired = false
+    ttl := d.config.CacheTTL - time.Since(page.Stored)
+    if ttl <= 0 {
+        if !d.config.UseStale {
+            return CacheEntry{}, false
+        }
+        entry.Expired = true
+        ttl += d.config.StaleExpiry
+    }
+    if ttl <= 0 {
+        return CacheEntry{}, false
+    }
+    ttl, fresh := localTTL(entry, ttl)
+    if !fresh {
+        return CacheEntry{}, false
+    }
+    cacheLocal(page.Key, entry, ttl, d.config)
+    return entry, true
+}
+
+// indexLocked adds the page file name to the index
+func (d *diskStore) indexLocked(name string, page diskPage, size int64) *diskRecord {
+    rec := &diskRecord{
+        key:     page.Key,
+        tags:    page.Entry.Tags,
+        size:    size,
+        stored:  page.Stored,
+        expires: d.expiresAt(page.Entry, page.Stored),
+        access:  page.Stored,
+        written: true,
+    }
+    d.index[name] = rec
+    d.bytes += size
+    return rec
+}
+
+// evict removes the page of key
+func (d *diskStore) evict(key string) {
+    if d == nil {
+        return
+    }
+    d.delete(diskName(key))
+}
+
+func (d *diskStore) delete(name string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if rec, ok := d.index[name]; ok {
+        d.removeLocked(name, rec)
+    } else {
+        os.Remove(d.path(name))
+    }
+}
+
+// removeLocked forgets rec and deletes its file, also an older version while
+// rec is still queued. Files are only removed with the lock held, so the
+// writer cannot rename a page in at the same time.
+func (d *diskStore) removeLocked(name string, rec *diskRecord) {
+    delete(d.index, name)
+    d.bytes -= rec.size
+    os.Remove(d.path(name))
+}
+
+// purge removes the pages whose tags satisfy match and returns the count
+func (d *diskStore) purge(match func(tags []string) bool) int {
+    if d == nil {
+        return 0
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    purged := 0
+    for name, rec := range d.index {
+        if match(rec.tags) {
+            d.removeLocked(name, rec)
+            purged++
+        }
+    }
+    return purged
+}
+
+// flush removes every page file, including those not indexed yet
+func (d *diskStore) flush() {
+    if d == nil {
+        return
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    entries, _ := os.ReadDir(d.dir)
+    for _, entry := range entries {
+        if entry.IsDir() && entry.Name() != diskTmpDir {
+            os.RemoveAll(filepath.Join(d.dir, entry.Name()))
+        }
+    }
+    d.index = make(map[string]*diskRecord)
+    d.bytes = 0
+}
+
+// evictLocked removes the least recently used of a few sampled pages until
+// the directory fits DISK_MAX_MB
+func (d *diskStore) evictLocked() {
+    for d.maxBytes > 0 && d.bytes > d.maxBytes && len(d.index) > 1 {
+        var victimName string
+        var victim *diskRecord
+        sampled := 0
+        for name, rec := range d.index {
+            if rec.written && (victim == nil || rec.access.Before(victim.access)) {
+                victimName, victim = name, rec
+            }
+            if sampled++; sampled >= evictionSampleSize && victim != nil {
+                break
+            }
+        }
+        if victim == nil {
+            return
+        }
+        d.removeLocked(victimName, victim)
+        atomic.AddInt64(&d.evictions, 1)
+    }
+}
+
+// warm indexes the page files left by a previous run, removing corrupt and
+// expired ones, and loads the newest pages that fit CACHE_MAX_MB into memory
+func (d *diskStore) warm() {
+    start := time.Now()
+    type candidate struct {
+        name   string
+        stored time.Time
+        size   int64
+    }
+    var candidates []candidate
+
+    d.walk(func(name, path string, info os.FileInfo) {
+        page, err := d.read(name)
+        if err != nil {
+            return
+        }
+        if !time.Now().Before(d.expiresAt(page.Entry, page.Stored)) {
+            atomic.AddInt64(&d.expired, 1)
+            d.delete(name)
+            return
+        }
+        d.mu.Lock()
+        if _, ok := d.index[name]; !ok {
+            d.indexLocked(name, page, info.Size())
+        }
+        d.mu.Unlock()
+        candidates = append(candidates, candidate{name, page.Stored, entrySize(page.Key, page.Entry)})
+    })
+    d.mu.Lock()
+    d.indexed = true
+    d.mu.Unlock()
+
+    // Newest pages first until the memory tier is full, then inserted oldest
+    // first, so the newest end up most recently used
+    sort.Slice(candidates, func(i, j int) bool { return candidates[i].stored.After(candidates[j].stored) })
+    var budget int64
+    n := 0
+    for ; n < len(candidates); n++ {
+        if d.config.CacheMaxBytes > 0 && budget+candidates[n].size > d.config.CacheMaxBytes {
+            break
+        }
+        budget += candidates[n].size
+    }
+    for i := n - 1; i >= 0; i-- {
+        if page, err := d.read(candidates[i].name); err == nil {
+            if _, ok := d.restore(page); ok {
+                atomic.AddInt64(&d.warmed, 1)
+            }
+        }
+    }
+
+    d.mu.Lock()
+    d.evictLocked()
+    d.mu.Unlock()
+    infoLog("Disk cache: %d pages indexed, %d loaded into memory in %.0fms\n",
+        len(candidates), atomic.LoadInt64(&d.warmed), time.Since(start).Seconds()*1000)
+}
+
+// compact removes expired pages, files the index does not know (left by a
+// crash or an older format) and stale temporary files, then trims the
+// directory to DISK_MAX_MB
+func (d *diskStore) compact() {
+    now := time.Now()
+    var reclaimed int64
+
+    d.mu.Lock()
+    for name, rec := range d.index {
+        if rec.written && !now.Before(rec.expires) {
+            reclaimed += rec.size
+            d.removeLocked(name, rec)
+            atomic.AddInt64(&d.expired, 1)
+        }
+    }
+    d.mu.Unlock()
+
+    d.walk(func(name, path string, info os.FileInfo) {
+        d.mu.Lock()
+        _, known := d.index[name]
+        if !known && now.Sub(info.ModTime()) > diskTmpMaxAge {
+            reclaimed += info.Size()
+            os.Remove(path)
+        }
+        d.mu.Unlock()
+    })
+
+    tmps, _ := os.ReadDir(filepath.Join(d.dir, diskTmpDir))
+    for _, tmp := range tmps {
+        if info, err := tmp.Info(); err == nil && now.Sub(info.ModTime()) > diskTmpMaxAge {
+            reclaimed += info.Size()
+            os.Remove(filepath.Join(d.dir, diskTmpDir, tmp.Name()))
+        }
+    }
+
+    d.mu.Lock()
+    before := d.bytes
+    d.evictLocked()
+    reclaimed += before - d.bytes
+    d.mu.Unlock()
+
+    atomic.AddInt64(&d.compactions, 1)
+    atomic.AddInt64(&d.reclaimed, reclaimed)
+    if d.config.Debug {
+        debugLog("🗜️  Disk cache compacted, %d bytes reclaimed\n", reclaimed)
+    }
+}
+
+// walk calls fn for every page file
+func (d *diskStore) walk(fn func(name, path string, info os.FileInfo)) {
+    dirs, _ := os.ReadDir(d.dir)
+    for _, dir := range dirs {
+        if !dir.IsDir() || dir.Name() == diskTmpDir {
+            continue
+        }
+        files, _ := os.ReadDir(filepath.Join(d.dir, dir.Name()))
+        for _, file := range files {
+            if !strings.HasSuffix(file.Name(), diskPageExt) {
+                continue
+            }
+            info, err := file.Info()
+            if err != nil {
+                continue
+            }
+            fn(strings.TrimSuffix(file.Name(), diskPageExt), filepath.Join(d.dir, dir.Name(), file.Name()), info)
+        }
+    }
+}
+
+// encodeDiskPage serializes page with its header and checksum
+func encodeDiskPage(page diskPage, level int) ([]byte, error) {
+    data, err := json.Marshal(page)
+    if err != nil {
+        return nil, err
+    }
+    payload, err := encodeCmCacheData(data, level)
+    if err != nil {
+        return nil, err
+    }
+
+    var buf bytes.Buffer
+    buf.Grow(diskHeaderSize + len(payload))
+    buf.WriteString(diskMagic)
+    buf.WriteByte(diskVersion)
+    binary.Write(&buf, binary.BigEndian, crc32.Checksum(payload, crc32c))
+    binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+    buf.Write(payload)
+    return buf.Bytes(), nil
+}
+
+// decodeDiskPage checks the header and checksum of a page file
+func decodeDiskPage(data []byte) (diskPage, error) {
+    var page diskPage
+    if len(data) < diskHeaderSize || string(data[:len(diskMagic)]) != diskMagic {
+        return page, errDiskCorrupt
+    }
+    if version := data[len(diskMagic)]; version != diskVersion {
+        return page, fmt.Errorf("disk cache: unknown page format %d", version)
+    }
+    sum := binary.BigEndian.Uint32(data[len(diskMagic)+1:])
+    length := binary.BigEndian.Uint32(data[len(diskMagic)+5:])
+    payload := data[diskHeaderSize:]
+    if uint32(len(payload)) != length || crc32.Checksum(payload, crc32c) != sum {
+        return page, errDiskCorrupt
+    }
+
+    decoded, err := decodeCmCacheData(payload)
+    if err != nil {
+        return page, err
+    }
+    if err := json.Unmarshal(decoded, &page); err != nil {
+        return page, fmt.Errorf("disk cache: %w", err)
+    }
+    return page, nil
+}
+
+func (d *diskStore) snapshot() diskSnapshot {
+    if d == nil {
+        return diskSnapshot{}
+    }
+    d.mu.Lock()
+    entries, size := len(d.index), d.bytes
+    d.mu.Unlock()
+    return diskSnapshot{
+        Dir:         d.dir,
+        Entries:     entries,
+        Bytes:       size,
+        MaxBytes:    d.maxBytes,
+        QueueDepth:  len(d.queue),
+        Hits:        atomic.LoadInt64(&d.hits),
+        Misses:      atomic.LoadInt64(&d.misses),
+        Writes:      atomic.LoadInt64(&d.writes),
+        WriteErrors: atomic.LoadInt64(&d.writeErrors),
+        Dropped:     atomic.LoadInt64(&d.dropped),
+        Corrupt:     atomic.LoadInt64(&d.corrupt),
+        Evictions:   atomic.LoadInt64(&d.evictions),
+        Expired:     atomic.LoadInt64(&d.expired),
+        Compactions: atomic.LoadInt64(&d.compactions),
+        Reclaimed:   atomic.LoadInt64(&d.reclaimed),
+        Warmed:      atomic.LoadInt64(&d.warmed),
+    }
+}
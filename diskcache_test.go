@@ -0,0 +1,92 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// useDisk installs an empty disk tier in a temporary directory
+func useDisk(t *testing.T) *diskStore {
+    t.Helper()
+    config := *loadConfig()
+    config.DiskDir = t.TempDir()
+    config.CacheTTL = time.Hour
+    config.UseStale = true
+    config.StaleExpiry = time.Hour
+    config.GraceTTL = 24 * time.Hour
+    config.CompressData = 0
+
+    d := &diskStore{
+        dir:    config.DiskDir,
+        config: &config,
+        queue:  make(chan diskWrite, 1),
+        index:  make(map[string]*diskRecord),
+    }
+    savedDisk, savedGrace, savedLocal := diskCache, graceCache, localCache
+    diskCache, graceCache, localCache = d, nil, newPageCache(0, 0, "lru")
+    t.Cleanup(func() {
+        diskCache, graceCache, localCache = savedDisk, savedGrace, savedLocal
+    })
+    return d
+}
+
+// writePage puts a page file for key on disk as if it was stored age ago
+func writePage(t *testing.T, d *diskStore, key string, age time.Duration) {
+    t.Helper()
+    data, err := encodeDiskPage(diskPage{Key: key, Stored: time.Now().Add(-age), Entry: CacheEntry{Content: "page " + key}}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := d.path(diskName(key))
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(path, data, 0o644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestGraceFallsBackToDisk(t *testing.T) {
+    d := useDisk(t)
+    writePage(t, d, "RECENT", 3*time.Hour)
+    writePage(t, d, "OLD", 25*time.Hour)
+
+    if _, ok := d.restore(diskPage{Key: "RECENT", Stored: time.Now().Add(-3 * time.Hour)}); ok {
+        t.Fatal("page past CACHE_TTL + STALE_TTL restored to memory")
+    }
+    entry, source, ok := graceEntry("RECENT")
+    if !ok || source != "disk" || entry.Content != "page RECENT" || !entry.Expired {
+        t.Errorf("graceEntry = %q from %q, %v; want the expired disk copy", entry.Content, source, ok)
+    }
+    if entry, ok := d.graceCopy("OLD"); ok {
+        t.Errorf("copy older than GRACE_TTL served: %q", entry.Content)
+    }
+
+    stored := time.Now().Add(-3 * time.Hour)
+    if expires := d.expiresAt(CacheEntry{}, stored); !expires.Equal(stored.Add(24 * time.Hour)) {
+        t.Errorf("page file kept until %v, want GRACE_TTL after it was stored", expires)
+    }
+}
+
+func TestDiskLoadSkipsUnindexedPagesOnceWarm(t *testing.T) {
+    d := useDisk(t)
+    writePage(t, d, "BEFORE", time.Minute)
+    d.warm()
+
+    // Written behind the index's back after warm: never read
+    writePage(t, d, "AFTER", time.Minute)
+    if _, ok := d.load("AFTER"); ok {
+        t.Error("page the index does not know was read from disk")
+    }
+    if entry, ok := d.load("BEFORE"); !ok || entry.Content != "page BEFORE" {
+        t.Errorf("indexed page load = %q, %v", entry.Content, ok)
+    }
+
+    // While warm has not finished every file may still be a page
+    d.indexed = false
+    if entry, ok := d.load("AFTER"); !ok || entry.Content != "page AFTER" {
+        t.Errorf("load during warm-up = %q, %v", entry.Content, ok)
+    }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "html"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strings"
+    "sync"
+
+    "github.com/go-redis/redis/v8"
+)
+
+var (
+    esiRemovePattern  = regexp.MustCompile(`(?s)<esi:remove>.*?</esi:remove>`)
+    esiCommentPattern = regexp.MustCompile(`(?s)<esi:comment[^>]*/>`)
+    esiTextPattern    = regexp.MustCompile(`(?s)<!--esi(.*?)-->`)
+    esiIncludePattern = regexp.MustCompile(`(?s)<esi:include\s[^>]*?(?:/>|>\s*</esi:include>)`)
+    esiSrcPattern     = regexp.MustCompile(`\ssrc\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// assembleESI returns entry with its ESI includes resolved when ESI is on.
+// The cached entry keeps the raw markup, since fragments expire on their own.
+func assembleESI(r *http.Request, entry CacheEntry, config *CacheConfig) CacheEntry {
+    if config.ESI && hasESI(entry) {
+        entry.Content = processESI(r, entry.Content, 0, config)
+    }
+    return entry
+}
+
+// hasESI reports whether a page needs the ESI processor, like the text/*
+// do_esi rule of Magento's VCL
+func hasESI(entry CacheEntry) bool {
+    contentType := entry.Headers.Get("Content-Type")
+    if contentType != "" && !strings.HasPrefix(contentType, "text/") {
+        return false
+    }
+    return strings.Contains(entry.Content, "<esi:") || strings.Contains(entry.Content, "<!--esi")
+}
+
+// processESI assembles a page: <esi:remove> and <esi:comment> are dropped,
+// <!--esi ...--> is unwrapped and every <esi:include> is replaced by its
+// fragment. Fragments are fetched in parallel and cached on their own, and
+// the ones they include are resolved up to ESI_MAX_DEPTH levels deep. A
+// fragment that fails or times out is left out, as Varnish does.
+func processESI(r *http.Request, content string, depth int, config *CacheConfig) string {
+    content = esiRemovePattern.ReplaceAllString(content, "")
+    content = esiCommentPattern.ReplaceAllString(content, "")
+    content = esiTextPattern.ReplaceAllString(content, "$1")
+
+    includes := esiIncludePattern.FindAllStringIndex(content, -1)
+    if len(includes) == 0 {
+        return content
+    }
+    if depth >= config.ESIMaxDepth {
+        warnLog("ESI: nesting deeper than %d levels under %s, leaving %d includes out\n", config.ESIMaxDepth, r.URL.Path, len(includes))
+        return esiIncludePattern.ReplaceAllString(content, "")
+    }
+
+    fragments := make([]string, len(includes))
+    var wg sync.WaitGroup
+    for i, loc := range includes {
+        src := esiSource(content[loc[0]:loc[1]])
+        if src == "" {
+            continue
+        }
+        wg.Add(1)
+        go func(i int, src string) {
+            defer wg.Done()
+            fragment, err := fetchFragment(r, src, config)
+            if err != nil {
+                errorLog("ESI fragment %s failed: %v\n", src, err)
+                return
+            }
+            fragments[i] = processESI(r, fragment, depth+1, config)
+        }(i, src)
+    }
+    wg.Wait()
+
+    var b strings.Builder
+    last := 0
+    for i, loc := range includes {
+        b.WriteString(content[last:loc[0]])
+        b.WriteString(fragments[i])
+        last = loc[1]
+    }
+    b.WriteString(content[last:])
+    return b.String()
+}
+
+// esiSource returns the unescaped src attribute of an include tag
+func esiSource(tag string) string {
+    m := esiSrcPattern.FindStringSubmatch(tag)
+    if m == nil {
+        return ""
+    }
+    return html.UnescapeString(m[1] + m[2])
+}
+
+// fetchFragment returns the body of one ESI include. The fragment is requested
+// like a page of the same visitor (cookies, vary, store), so it gets its own
+// Magento cache key, and goes through the local cache, Redis and the backend.
+func fetchFragment(r *http.Request, src string, config *CacheConfig) (string, error) {
+    u, err := url.Parse(src)
+    if err != nil {
+        return "", err
+    }
+    // Magento renders absolute URLs; the fragment always comes from our backend
+    target := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+    if target.Path == "" {
+        target.Path = "/"
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), config.ESITimeout)
+    defer cancel()
+    sub := r.Clone(ctx)
+    sub.Method = http.MethodGet
+    sub.URL = target
+    sub.RequestURI = target.RequestURI()
+    sub.Body = http.NoBody
+    sub.ContentLength = 0
+
+    cacheKey := getCacheKeyWithConfig(sub, config)
+    if cacheKey != "" && config.UseCache {
+        entry, found := localCache.Get(cacheKey)
+        if !found {
+            entry, found = diskCache.load(cacheKey)
+        }
+        if found {
+            if entry.Expired {
+                revalidation.schedule(sub, cacheKey)
+            }
+            return entry.Content, nil
+        }
+    }
+    if cacheKey != "" && redisState.allow() {
+        redisCtx, cancelRedis := redisContext()
+        entry, err := loadRedisEntry(redisCtx, cacheKey)
+        cancelRedis()
+        if err == nil {
+            if config.UseCache {
+                setLocal(cacheKey, *entry, config)
+            }
+            return entry.Content, nil
+        } else if err != redis.Nil {
+            errorLog("Redis entry %s skipped: %v\n", cacheKey, err)
+        }
+    }
+
+    entry, err := proxyRequest(nil, sub)
+    if err != nil {
+        return "", err
+    }
+    if entry.Status != 0 && entry.Status != http.StatusOK {
+        return "", fmt.Errorf("backend answered %d", entry.Status)
+    }
+    if cacheKey != "" {
+        storeEntry(cacheKey, *entry, config)
+    }
+    return entry.Content, nil
+}
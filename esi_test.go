@@ -0,0 +1,126 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// useESI serves fragments from a backend mapping paths to bodies and returns
+// the request URIs it saw so far
+func useESI(t *testing.T, fragments map[string]string) func() []string {
+    t.Helper()
+    var mu sync.Mutex
+    var requested []string
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        requested = append(requested, r.URL.RequestURI())
+        mu.Unlock()
+        switch r.URL.Path {
+        case "/slow":
+            select {
+            case <-time.After(time.Second):
+            case <-r.Context().Done():
+                return
+            }
+        case "/missing":
+            w.WriteHeader(http.StatusNotFound)
+        case "/broken":
+            w.WriteHeader(http.StatusInternalServerError)
+        }
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        io.WriteString(w, fragments[r.URL.Path])
+    })
+    config := loadConfig()
+    config.ESI = true
+    config.ESIMaxDepth = 3
+    config.ESITimeout = time.Second
+
+    return func() []string {
+        mu.Lock()
+        defer mu.Unlock()
+        return append([]string(nil), requested...)
+    }
+}
+
+func assemble(t *testing.T, content string) string {
+    t.Helper()
+    r := httptest.NewRequest(http.MethodGet, "http://shop.example/page", nil)
+    return processESI(r, content, 0, loadConfig())
+}
+
+func TestESIMarkup(t *testing.T) {
+    seen := useESI(t, map[string]string{"/page_cache/block/esi": "<b>block</b>"})
+
+    got := assemble(t, `a<esi:remove><a href="/fallback">x</a></esi:remove>b<esi:comment text="note"/>c<!--esi <p>d</p>-->`+
+        `<esi:include src="http://shop.example/page_cache/block/esi?blocks=%5B%22header%22%5D&amp;handles=x" />e`)
+    if want := "abc <p>d</p><b>block</b>e"; got != want {
+        t.Errorf("assembled %q, want %q", got, want)
+    }
+    // Magento's absolute, HTML escaped src is fetched from the backend
+    if got := seen(); !slices.Equal(got, []string{"/page_cache/block/esi?blocks=%5B%22header%22%5D&handles=x"}) {
+        t.Errorf("fetched %q", got)
+    }
+}
+
+func TestESIDepthLimit(t *testing.T) {
+    seen := useESI(t, map[string]string{
+        "/one":   `1[<esi:include src="/two"/>]`,
+        "/two":   `2[<esi:include src="/three"/>]`,
+        "/three": `3[<esi:include src="/four"/>]`,
+        "/four":  `4`,
+    })
+    loadConfig().ESIMaxDepth = 2
+
+    if got, want := assemble(t, `<esi:include src="/one"/>`), "1[2[]]"; got != want {
+        t.Errorf("assembled %q, want %q", got, want)
+    }
+    if got := seen(); !slices.Equal(got, []string{"/one", "/two"}) {
+        t.Errorf("fetched %q, want nothing beyond ESI_MAX_DEPTH", got)
+    }
+}
+
+func TestESILeavesOutFailedFragments(t *testing.T) {
+    useESI(t, map[string]string{"/ok": "ok", "/missing": "not found page", "/broken": "error page"})
+    loadConfig().ESITimeout = 50 * time.Millisecond
+
+    start := time.Now()
+    got := assemble(t, `[<esi:include src="/ok"/>|<esi:include src="/slow"/>|<esi:include src="/missing"/>|<esi:include src="/broken"/>|<esi:include src=""/>]`)
+    if want := "[ok||||]"; got != want {
+        t.Errorf("assembled %q, want %q", got, want)
+    }
+    if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+        t.Errorf("assembly took %s, want the slow fragment cut off after ESI_TIMEOUT_MS", elapsed)
+    }
+}
+
+func TestESIPageKeepsRawMarkupInCache(t *testing.T) {
+    useESI(t, map[string]string{
+        "/esi-page": `<html><esi:include src="/block"/></html>`,
+        "/block":    "block",
+    })
+
+    for n := 1; n <= 2; n++ {
+        rec := getPage("/esi-page")
+        if got := rec.Body.String(); !strings.HasPrefix(got, "<html>block</html>") {
+            t.Errorf("request %d: body %q, want the block included", n, got)
+        }
+    }
+    cached := 0
+    for _, item := range localCache.Items() {
+        if strings.HasPrefix(item.Entry.Content, "<html>") {
+            cached++
+            if !strings.Contains(item.Entry.Content, "<esi:include") {
+                t.Errorf("cached page %q lost its include", item.Entry.Content)
+            }
+        }
+    }
+    if cached != 1 {
+        t.Errorf("%d pages cached, want 1", cached)
+    }
+}
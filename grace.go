@@ -0,0 +1,132 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// graceCache keeps the last good copy of every local page for GRACE_TTL, past
+// its normal and stale lifetimes, to answer when the backend is down. It holds
+// the same CacheEntry values as localCache, so page bodies are not duplicated
+// in memory while both have them, but every copy is charged its full size
+// against GRACE_MAX_MB; least recently used copies go first.
+var graceCache *pageCache
+
+var graceStats struct {
+    served int64 // Backend failures answered with a grace copy
+    missed int64 // Backend failures without any copy to serve
+}
+
+// initGrace creates the grace store when the local cache is used
+func initGrace(config *CacheConfig) {
+    if config.UseCache && config.GraceTTL > 0 {
+        graceCache = newPageCache(config.GraceMaxBytes, 0, "lru")
+        graceCache.startJanitor(time.Minute)
+    }
+}
+
+// keepGrace remembers entry as the newest copy of key
+func keepGrace(key string, entry CacheEntry, config *CacheConfig) {
+    if graceCache == nil {
+        return
+    }
+    entry.Expired = true
+    graceCache.Set(key, entry, config.GraceTTL)
+}
+
+// purgeGrace drops the grace copies of purged pages: keys, and every copy
+// whose tags satisfy match, since their local page may be long gone
+func purgeGrace(match func(tags []string) bool, keys ...string) {
+    if graceCache == nil {
+        return
+    }
+    for _, key := range keys {
+        graceCache.Delete(key)
+    }
+    if match == nil {
+        return
+    }
+    for key, item := range graceCache.Items() {
+        if match(item.Entry.Tags) {
+            graceCache.Delete(key)
+        }
+    }
+}
+
+// hasAnyTag reports whether pageTags contains one of tags
+func hasAnyTag(pageTags, tags []string) bool {
+    for _, pageTag := range pageTags {
+        for _, tag := range tags {
+            if pageTag == tag {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// backendFailure reports a fetch that should fall back to grace: no response
+// (connection error or timeout) or a 5xx from Magento
+func backendFailure(entry *CacheEntry, err error) (string, bool) {
+    if err != nil {
+        return "backend error", true
+    }
+    if entry.Status >= http.StatusInternalServerError {
+        return fmt.Sprintf("backend status %d", entry.Status), true
+    }
+    return "", false
+}
+
+// graceEntry returns the newest copy of key from the grace store, the disk
+// tier or Redis, in that order, and where it came from
+func graceEntry(cacheKey string) (CacheEntry, string, bool) {
+    if graceCache != nil {
+        if entry, found := graceCache.Get(cacheKey); found {
+            return entry, "local", true
+        }
+    }
+    if entry, found := diskCache.graceCopy(cacheKey); found {
+        return entry, "disk", true
+    }
+    if redisState.allow() {
+        redisCtx, cancel := redisContext()
+        entry, err := loadRedisEntry(redisCtx, cacheKey)
+        cancel()
+        if err == nil {
+            entry.Expired = true
+            return *entry, "redis", true
+        }
+    }
+    return CacheEntry{}, "", false
+}
+
+// serveGrace answers a failed backend fetch with the newest stale copy of the
+// page. It returns false when there is none and the failure must be shown.
+func serveGrace(w http.ResponseWriter, r *http.Request, cacheKey, reason string, startTime time.Time, config *CacheConfig) bool {
+    entry, source, ok := graceEntry(cacheKey)
+    if !ok {
+        atomic.AddInt64(&graceStats.missed, 1)
+        errorLog("⛔ %s for %s and no grace copy to serve\n", reason, r.URL.Path)
+        return false
+    }
+
+    atomic.AddInt64(&graceStats.served, 1)
+    errorLog("⚠️  %s for %s, serving %s grace copy from %s (age %.0fs)\n",
+        reason, r.URL.Path, cacheKey, source, entry.Age(time.Now()).Seconds())
+    w.Header().Set("Fast-Cache-Grace", reason)
+    serveContent(w, assembleESI(r, entry, config), startTime, "STALE")
+    return true
+}
+
+func graceSnapshot() map[string]interface{} {
+    snapshot := map[string]interface{}{
+        "served": atomic.LoadInt64(&graceStats.served),
+        "missed": atomic.LoadInt64(&graceStats.missed),
+    }
+    if graceCache != nil {
+        snapshot["store"] = graceCache.snapshot()
+    }
+    return snapshot
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// useGrace serves "page <path>" until fail is set, then runs fail instead,
+// with grace copies kept for an hour
+func useGrace(t *testing.T) *atomic.Value {
+    t.Helper()
+    var fail atomic.Value
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        if f, ok := fail.Load().(http.HandlerFunc); ok {
+            f(w, r)
+            return
+        }
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Write([]byte("page " + r.URL.Path))
+    })
+    config := loadConfig()
+    config.GraceTTL = time.Hour
+    savedGrace, savedDisk, savedTimeout := graceCache, diskCache, httpClient.Timeout
+    graceCache, diskCache = newPageCache(0, 0, "lru"), nil
+    t.Cleanup(func() {
+        graceCache, diskCache, httpClient.Timeout = savedGrace, savedDisk, savedTimeout
+    })
+    return &fail
+}
+
+// expireLocal drops the local copy of path, leaving its grace copy
+func expireLocal(path string) {
+    key := getCacheKeyWithConfig(httptest.NewRequest(http.MethodGet, "http://shop.example"+path, nil), loadConfig())
+    localCache.Delete(key)
+}
+
+func TestGraceAnswersBackendFailures(t *testing.T) {
+    tests := []struct {
+        name   string
+        fail   http.HandlerFunc
+        setup  func()
+        reason string
+    }{
+        {"server error", func(w http.ResponseWriter, r *http.Request) {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }, nil, "backend status 503"},
+        {"connection dropped", func(w http.ResponseWriter, r *http.Request) {
+            conn, _, err := w.(http.Hijacker).Hijack()
+            if err == nil {
+                conn.Close()
+            }
+        }, nil, "backend error"},
+        {"timeout", func(w http.ResponseWriter, r *http.Request) {
+            select {
+            case <-time.After(time.Second):
+            case <-r.Context().Done():
+            }
+        }, func() { httpClient.Timeout = 50 * time.Millisecond }, "backend error"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fail := useGrace(t)
+            path := "/grace-" + strings.ReplaceAll(tt.name, " ", "-")
+            if rec := getPage(path); rec.Header().Get("Fast-Cache") != "MISS" {
+                t.Fatalf("priming request Fast-Cache %q, want MISS", rec.Header().Get("Fast-Cache"))
+            }
+            expireLocal(path)
+            if tt.fail != nil {
+                fail.Store(tt.fail)
+            }
+            if tt.setup != nil {
+                tt.setup()
+            }
+
+            served := atomic.LoadInt64(&graceStats.served)
+            rec := getPage(path)
+            if rec.Code != http.StatusOK || rec.Body.String() != "page "+path {
+                t.Errorf("got %d %q, want the grace copy", rec.Code, rec.Body.String())
+            }
+            if rec.Header().Get("Fast-Cache") != "STALE" || rec.Header().Get("Fast-Cache-Grace") != tt.reason {
+                t.Errorf("Fast-Cache %q, Fast-Cache-Grace %q, want STALE and %q",
+                    rec.Header().Get("Fast-Cache"), rec.Header().Get("Fast-Cache-Grace"), tt.reason)
+            }
+            if got := atomic.LoadInt64(&graceStats.served) - served; got != 1 {
+                t.Errorf("%d grace answers counted, want 1", got)
+            }
+        })
+    }
+}
+
+func TestGraceWithoutCopyShowsFailure(t *testing.T) {
+    fail := useGrace(t)
+    fail.Store(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusInternalServerError)
+        w.Write([]byte("error page"))
+    }))
+
+    missed := atomic.LoadInt64(&graceStats.missed)
+    rec := getPage("/grace-never-cached")
+    if rec.Code != http.StatusInternalServerError || rec.Header().Get("Fast-Cache-Grace") != "" {
+        t.Errorf("got %d with Fast-Cache-Grace %q, want the backend's 500", rec.Code, rec.Header().Get("Fast-Cache-Grace"))
+    }
+    if got := atomic.LoadInt64(&graceStats.missed) - missed; got != 1 {
+        t.Errorf("%d missed grace answers counted, want 1", got)
+    }
+
+    loadConfig().Host = "127.0.0.1:1"
+    if rec := getPage("/grace-never-cached"); rec.Code != http.StatusBadGateway {
+        t.Errorf("connection error without a copy: %d, want 502", rec.Code)
+    }
+}
+
+func TestGraceIgnoresClientErrors(t *testing.T) {
+    fail := useGrace(t)
+    getPage("/grace-gone")
+    expireLocal("/grace-gone")
+    fail.Store(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNotFound)
+    }))
+
+    if rec := getPage("/grace-gone"); rec.Code != http.StatusNotFound || rec.Header().Get("Fast-Cache-Grace") != "" {
+        t.Errorf("got %d with Fast-Cache-Grace %q, want the 404", rec.Code, rec.Header().Get("Fast-Cache-Grace"))
+    }
+}
+
+func TestGraceFallsBackToRedis(t *testing.T) {
+    useGrace(t)
+    useFakeRedis(t)
+    graceCache = nil // Neither a local nor a disk copy
+
+    req := httptest.NewRequest(http.MethodGet, "http://shop.example/grace-redis", nil)
+    key := getCacheKeyWithConfig(req, loadConfig())
+    entry := CacheEntry{Content: "redis page", Created: time.Now().Add(-time.Minute)}
+    if err := saveRedisEntry(context.Background(), key, entry, nil, time.Hour); err != nil {
+        t.Fatal(err)
+    }
+    got, source, ok := graceEntry(key)
+    if !ok || source != "redis" || got.Content != "redis page" || !got.Expired {
+        t.Errorf("grace entry %q from %q (%v), want the expired Redis page", got.Content, source, ok)
+    }
+}
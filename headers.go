@@ -0,0 +1,95 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+)
+
+// defaultDenyHeaders are response headers that describe one delivery or the
+// backend itself; Magento's VCL drops or rewrites them before the browser
+const defaultDenyHeaders = "Cache-Control,Pragma,Expires,X-Magento-Cache-Control,X-Magento-Cache-Debug,X-Magento-Tags,X-Magento-Debug,Server,X-Powered-By"
+
+// uncachedHeaders are never stored: they belong to one response or
+// connection, or no longer describe the stored body
+var uncachedHeaders = map[string]bool{
+    "Set-Cookie":         true,
+    "Date":               true,
+    "Age":                true,
+    "Content-Length":     true,
+    "Content-Encoding":   true,
+    "Transfer-Encoding":  true,
+    "Connection":         true,
+    "Keep-Alive":         true,
+    "Proxy-Connection":   true,
+    "Proxy-Authenticate": true,
+    "Trailer":            true,
+    "Upgrade":            true,
+}
+
+// hopByHopHeaders describe the backend connection, not the response
+var hopByHopHeaders = []string{
+    "Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+    "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// liveHeaders returns the backend headers the current client gets: all of
+// them but the hop-by-hop ones and Content-Length, since the body may be
+// decompressed or assembled
+func liveHeaders(headers http.Header) http.Header {
+    live := headers.Clone()
+    for _, name := range hopByHopHeaders {
+        live.Del(name)
+    }
+    live.Del("Content-Length")
+    return live
+}
+
+// cachedCopy returns entry with only the headers that may be stored and
+// replayed to other clients
+func cachedCopy(entry CacheEntry, config *CacheConfig) CacheEntry {
+    entry.Headers = config.CachedHeaders.filter(entry.Headers)
+    return entry
+}
+
+// headerPolicy decides which backend response headers are cached and replayed.
+// With an allow list only those headers are kept, otherwise all but the denied.
+type headerPolicy struct {
+    allow map[string]bool
+    deny  map[string]bool
+}
+
+// parseHeaderPolicy reads CACHE_HEADERS_ALLOW and CACHE_HEADERS_DENY
+func parseHeaderPolicy(allow, deny string) headerPolicy {
+    return headerPolicy{allow: headerSet(allow), deny: headerSet(deny)}
+}
+
+func headerSet(spec string) map[string]bool {
+    set := make(map[string]bool)
+    for _, name := range strings.Split(spec, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            set[http.CanonicalHeaderKey(name)] = true
+        }
+    }
+    return set
+}
+
+// keeps reports whether the header name is cached
+func (p headerPolicy) keeps(name string) bool {
+    name = http.CanonicalHeaderKey(name)
+    if uncachedHeaders[name] || p.deny[name] {
+        return false
+    }
+    return len(p.allow) == 0 || p.allow[name]
+}
+
+// filter returns the cached subset of headers
+func (p headerPolicy) filter(headers map[string][]string) http.Header {
+    kept := make(http.Header, len(headers))
+    for name, values := range headers {
+        if len(values) > 0 && p.keeps(name) {
+            name = http.CanonicalHeaderKey(name)
+            kept[name] = append(kept[name], values...)
+        }
+    }
+    return kept
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+    "crypto/sha1"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    varyCookieName = "X-Magento-Vary" // Magento\Framework\App\Response\Http::COOKIE_VARY_STRING
+
+    // Laminas\Uri\Uri character classes used when rendering the request URI
+    uriUnreserved = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_-.~"
+    uriPathChars  = uriUnreserved + ")(:@&=+$,/;%"
+    uriQueryChars = uriUnreserved + "!$&'()*+,;=" + "%:@/?"
+)
+
+// marketingParamPatterns are stripped from the URI by Identifier::getValue since Magento 2.4.7
+var marketingParamPatterns = compilePatterns(
+    `&?gad_source\=[^&]+`,
+    `&?gbraid\=[^&]+`,
+    `&?wbraid\=[^&]+`,
+    `&?_gl\=[^&]+`,
+    `&?dclid\=[^&]+`,
+    `&?gclsrc\=[^&]+`,
+    `&?srsltid\=[^&]+`,
+    `&?msclkid\=[^&]+`,
+    `&?gclid\=[^&]+`,
+    `&?cx\=[^&]+`,
+    `&?ie\=[^&]+`,
+    `&?cof\=[^&]+`,
+    `&?siteurl\=[^&]+`,
+    `&?zanpid\=[^&]+`,
+    `&?origin\=[^&]+`,
+    `&?fbclid\=[^&]+`,
+    `&?mc_(.*?)\=[^&]+`,
+    `&?utm_(.*?)\=[^&]+`,
+    `&?_bta_(.*?)\=[^&]+`,
+)
+
+// marketingParamNames are the literal names of marketingParamPatterns
+var marketingParamNames = literalNames(marketingParamPatterns)
+
+// getCacheKeyWithConfig generates the page cache id exactly like Magento's
+// Identifier::getValue followed by the cache frontend id normalization.
+// An empty key means Magento could not serialize the identifier either.
+func getCacheKeyWithConfig(r *http.Request, config *CacheConfig) string {
+    idPrefix, jsonStr, err := identifierData(r, config)
+    if err != nil {
+        if config.Debug {
+            warnLog("Identifier not serializable: %v\n", err)
+        }
+        return ""
+    }
+
+    if config.Debug {
+        log.Printf("HASH-DATA: %s", jsonStr)
+    }
+
+    sum := sha1.Sum([]byte(jsonStr))
+    return normalizeCacheId(idPrefix + hex.EncodeToString(sum[:]))
+}
+
+// identifierData returns the prefix and the PHP JSON Magento hashes into the
+// page cache id
+func identifierData(r *http.Request, config *CacheConfig) (string, string, error) {
+    data := []interface{}{
+        isSecureRequest(r),
+        magentoUriString(r, config),
+        requestVary(r, config),
+    }
+
+    // CacheIdentifierPlugin prefixes the hash with the design exception theme.
+    // Since 2.4.7 IdentifierStoreReader adds the store run to the data, which
+    // json_encode then renders as an object; before, the plugin prefixed it too.
+    var idPrefix string
+    if theme, ok := designTheme(r, config); ok {
+        idPrefix = "DESIGN=" + theme + "|"
+    }
+    extras := identifierExtras(r, config)
+    var payload interface{} = data
+    if len(extras) > 0 {
+        if magentoAtLeast(config, "2.4.7") {
+            payload = identifierWithExtras(data, extras)
+        } else {
+            for _, extra := range extras {
+                idPrefix += fmt.Sprintf("%s=%v|", extra.Key, extra.Value)
+            }
+        }
+    }
+
+    jsonStr, err := phpJSONEncode(payload)
+    return idPrefix, jsonStr, err
+}
+
+// identifierWithExtras turns the identifier list into the associative array
+// PHP has after string keys are added to it
+func identifierWithExtras(data []interface{}, extras []phpKeyValue) []phpKeyValue {
+    assoc := make([]phpKeyValue, 0, len(data)+len(extras))
+    for i, value := range data {
+        assoc = append(assoc, phpKeyValue{Key: strconv.Itoa(i), Value: value})
+    }
+    return append(assoc, extras...)
+}
+
+// getUrl returns the request URI string Magento uses for the identifier
+func getUrl(r *http.Request) string {
+    return magentoUriString(r, loadConfig())
+}
+
+// isSecureRequest mirrors Request::isSecure with the default SSL offloader header
+func isSecureRequest(r *http.Request) bool {
+    return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// magentoUriString rebuilds Laminas Request::getUriString() from the raw request line
+func magentoUriString(r *http.Request, config *CacheConfig) string {
+    scheme := "http"
+    if isSecureRequest(r) {
+        scheme = "https"
+    }
+
+    host := magentoHost(r, config)
+
+    requestURI := r.RequestURI
+    if requestURI == "" {
+        requestURI = r.URL.RequestURI()
+    }
+    // Absolute-form request targets carry their own scheme and authority
+    if i := strings.Index(requestURI, "://"); i > 0 && !strings.Contains(requestURI[:i], "/") {
+        rest := requestURI[i+3:]
+        if j := strings.IndexAny(rest, "/?"); j >= 0 {
+            requestURI = rest[j:]
+        } else {
+            requestURI = ""
+        }
+    }
+
+    path, query := requestURI, ""
+    if i := strings.IndexByte(requestURI, '?'); i >= 0 {
+        path, query = requestURI[:i], requestURI[i+1:]
+    }
+    if config.QueryNormalize {
+        query = normalizeQuery(query, config)
+    }
+
+    uri := scheme + "://" + host
+    if path != "" {
+        uri += laminasEncode(path, uriPathChars)
+    } else if query != "" && query != "0" {
+        uri += "/"
+    }
+    // PHP treats "0" as an empty query
+    if query != "" && query != "0" {
+        uri += "?" + laminasEncode(query, uriQueryChars)
+    }
+
+    if magentoAtLeast(config, "2.4.7") {
+        for i, pattern := range marketingParamPatterns {
+            // Most URLs carry none of them, and the regexps are slow to rule that out
+            if strings.Contains(uri, marketingParamNames[i]) {
+                uri = pattern.ReplaceAllLiteralString(uri, "")
+            }
+        }
+    }
+
+    if config.Debug {
+        log.Printf("URL: %s", uri)
+    }
+    return uri
+}
+
+// laminasEncode percent-encodes every byte outside allowed, plus any '%' that
+// does not start a valid escape, like Laminas\Uri\Uri::encodePath/encodeQueryFragment
+func laminasEncode(s, allowed string) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if c == '%' && (i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2])) {
+            b.WriteString("%25")
+            continue
+        }
+        if strings.IndexByte(allowed, c) >= 0 {
+            b.WriteByte(c)
+            continue
+        }
+        fmt.Fprintf(&b, "%%%02X", c)
+    }
+    return b.String()
+}
+
+func isHex(c byte) bool {
+    return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// varyString returns the X-Magento-Vary value as Request::get() resolves it:
+// query parameter first, then cookie. PHP treats "" and "0" as unset.
+func varyString(r *http.Request) interface{} {
+    value, found := phpQueryParam(r.URL.RawQuery, varyCookieName)
+    if !found {
+        value, found = phpCookie(r, varyCookieName)
+    }
+    if !found || value == "" || value == "0" {
+        return nil
+    }
+    return value
+}
+
+// phpQueryParam looks a parameter up the way $_GET is populated (last one wins)
+func phpQueryParam(rawQuery, name string) (string, bool) {
+    var value string
+    var found bool
+    for _, pair := range strings.Split(rawQuery, "&") {
+        key, val, _ := strings.Cut(pair, "=")
+        if phpURLDecode(key) == name {
+            value, found = phpURLDecode(val), true
+        }
+    }
+    return value, found
+}
+
+// phpCookie looks a cookie up the way $_COOKIE is populated (first one wins)
+func phpCookie(r *http.Request, name string) (string, bool) {
+    for _, line := range r.Header.Values("Cookie") {
+        for _, pair := range strings.Split(line, ";") {
+            key, val, _ := strings.Cut(strings.TrimLeft(pair, " \t"), "=")
+            if phpURLDecode(key) == name {
+                return phpURLDecode(val), true
+            }
+        }
+    }
+    return "", false
+}
+
+// phpURLDecode behaves like PHP urldecode(): '+' is a space and invalid escapes are kept
+func phpURLDecode(s string) string {
+    if decoded, err := url.QueryUnescape(s); err == nil {
+        return decoded
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        switch {
+        case s[i] == '+':
+            b.WriteByte(' ')
+        case s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+            v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+            b.WriteByte(byte(v))
+            i += 2
+        default:
+            b.WriteByte(s[i])
+        }
+    }
+    return b.String()
+}
+
+// phpKeyValue is one entry of an associative PHP array, kept in insertion order
+type phpKeyValue struct {
+    Key   string
+    Value interface{}
+}
+
+// phpJSONEncode serializes like PHP json_encode() with default flags: slashes
+// and non-ASCII characters are escaped, <, > and & are not. A []interface{} is
+// a list, a []phpKeyValue an associative array.
+func phpJSONEncode(v interface{}) (string, error) {
+    var b strings.Builder
+    if err := writePHPJSON(&b, v); err != nil {
+        return "", err
+    }
+    return b.String(), nil
+}
+
+func writePHPJSON(b *strings.Builder, v interface{}) error {
+    switch val := v.(type) {
+    case nil:
+        b.WriteString("null")
+    case bool:
+        b.WriteString(strconv.FormatBool(val))
+    case int:
+        b.WriteString(strconv.Itoa(val))
+    case string:
+        return writePHPJSONString(b, val)
+    case []interface{}:
+        b.WriteByte('[')
+        for i, item := range val {
+            if i > 0 {
+                b.WriteByte(',')
+            }
+            if err := writePHPJSON(b, item); err != nil {
+                return err
+            }
+        }
+        b.WriteByte(']')
+    case []phpKeyValue:
+        b.WriteByte('{')
+        for i, item := range val {
+            if i > 0 {
+                b.WriteByte(',')
+            }
+            if err := writePHPJSONString(b, item.Key); err != nil {
+                return err
+            }
+            b.WriteByte(':')
+            if err := writePHPJSON(b, item.Value); err != nil {
+                return err
+            }
+        }
+        b.WriteByte('}')
+    default:
+        return fmt.Errorf("php json: unsupported type %T", v)
+    }
+    return nil
+}
+
+func writePHPJSONString(b *strings.Builder, s string) error {
+    if !utf8.ValidString(s) {
+        return errors.New("php json: malformed UTF-8 characters")
+    }
+    b.WriteByte('"')
+    for _, c := range s {
+        switch {
+        case c == '"':
+            b.WriteString(`\"`)
+        case c == '\\':
+            b.WriteString(`\\`)
+        case c == '/':
+            b.WriteString(`\/`)
+        case c == '\b':
+            b.WriteString(`\b`)
+        case c == '\f':
+            b.WriteString(`\f`)
+        case c == '\n':
+            b.WriteString(`\n`)
+        case c == '\r':
+            b.WriteString(`\r`)
+        case c == '\t':
+            b.WriteString(`\t`)
+        case c < 0x20:
+            fmt.Fprintf(b, `\u%04x`, c)
+        case c < 0x80:
+            b.WriteRune(c)
+        case c < 0x10000:
+            fmt.Fprintf(b, `\u%04x`, c)
+        default:
+            c -= 0x10000
+            fmt.Fprintf(b, `\u%04x\u%04x`, 0xD800+(c>>10), 0xDC00+(c&0x3FF))
+        }
+    }
+    b.WriteByte('"')
+    return nil
+}
+
+// normalizeCacheId applies the cache frontend id rules: the Zend adapter
+// upper-cases the id and Magento\Framework\Cache\Core replaces '.' with "__"
+// and every other character outside [a-zA-Z0-9_] with '_'
+func normalizeCacheId(id string) string {
+    id = strings.ReplaceAll(strings.ToUpper(id), ".", "__")
+    var b strings.Builder
+    for i := 0; i < len(id); i++ {
+        c := id[i]
+        if c == '_' || '0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' {
+            b.WriteByte(c)
+        } else {
+            b.WriteByte('_')
+        }
+    }
+    return b.String()
+}
+
+// magentoAtLeast reports whether the configured Magento version is >= version
+func magentoAtLeast(config *CacheConfig, version string) bool {
+    have := strings.Split(config.MagentoVersion, ".")
+    want := strings.Split(version, ".")
+    for i := 0; i < len(want); i++ {
+        var h, w int
+        if i < len(have) {
+            h, _ = strconv.Atoi(strings.SplitN(have[i], "-", 2)[0])
+        }
+        w, _ = strconv.Atoi(want[i])
+        if h != w {
+            return h > w
+        }
+    }
+    return true
+}
+
+// literalNames returns the parameter name every match of a marketing
+// parameter pattern has to contain: the text before the first metacharacter
+func literalNames(patterns []*regexp.Regexp) []string {
+    names := make([]string, len(patterns))
+    for i, pattern := range patterns {
+        name := strings.TrimPrefix(pattern.String(), "&?")
+        if j := strings.IndexAny(name, `(\`); j >= 0 {
+            name = name[:j]
+        }
+        names[i] = name
+    }
+    return names
+}
+
+func compilePatterns(patterns ...string) []*regexp.Regexp {
+    compiled := make([]*regexp.Regexp, len(patterns))
+    for i, pattern := range patterns {
+        compiled[i] = regexp.MustCompile(pattern)
+    }
+    return compiled
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "bufio"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "testing"
+)
+
+// keyCorpusCase is one recorded identifier case: a request, the settings it is
+// keyed with and the data and key the builder produced for it
+type keyCorpusCase struct {
+    Name           string            `json:"name"`
+    MagentoVersion string            `json:"magento_version,omitempty"`
+    TLS            bool              `json:"tls,omitempty"`
+    Host           string            `json:"host"`
+    StoreMap       string            `json:"store_map,omitempty"`
+    StoreViews     string            `json:"store_views,omitempty"`
+    CurrencyCookie string            `json:"currency_cookie,omitempty"`
+    CryptKey       string            `json:"crypt_key,omitempty"`
+    DesignExceptions string          `json:"design_exceptions,omitempty"`
+    QueryNormalize   bool            `json:"query_normalize,omitempty"`
+    URI            string            `json:"uri"`
+    Headers        map[string]string `json:"headers,omitempty"`
+    Data           string            `json:"data"`
+    Key            string            `json:"key"`
+}
+
+// config builds the proxy settings the case was recorded with
+func (c keyCorpusCase) config() *CacheConfig {
+    config := *loadConfig()
+    config.Host = ""
+    config.PreserveHost = false
+    config.Stores = parseStoreMap(c.StoreMap)
+    config.StoreViews = parseStoreViews(c.StoreViews)
+    config.CurrencyCookie = c.CurrencyCookie
+    config.CryptKey = c.CryptKey
+    config.DesignExceptions = parseDesignExceptions(c.DesignExceptions)
+    config.QueryNormalize = c.QueryNormalize
+    config.QueryStripParams = parseStripParams(defaultStripParams)
+    config.Debug = false
+    config.MagentoVersion = "2.4.7"
+    if c.MagentoVersion != "" {
+        config.MagentoVersion = c.MagentoVersion
+    }
+    return &config
+}
+
+// request parses the case as a raw HTTP/1.1 request so RequestURI stays untouched
+func (c keyCorpusCase) request() (*http.Request, error) {
+    var b strings.Builder
+    fmt.Fprintf(&b, "GET %s HTTP/1.1\r\nHost: %s\r\n", c.URI, c.Host)
+    names := make([]string, 0, len(c.Headers))
+    for name := range c.Headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Fprintf(&b, "%s: %s\r\n", name, c.Headers[name])
+    }
+    b.WriteString("\r\n")
+
+    r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(b.String())))
+    if err != nil {
+        return nil, err
+    }
+    if c.TLS {
+        r.TLS = &tls.ConnectionState{}
+    }
+    return r, nil
+}
+
+func TestIdentifierGoldenCorpus(t *testing.T) {
+    raw, err := os.ReadFile("testdata/identifier_golden.json")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var cases []keyCorpusCase
+    if err := json.Unmarshal(raw, &cases); err != nil {
+        t.Fatalf("invalid key corpus: %v", err)
+    }
+
+    for _, c := range cases {
+        t.Run(c.Name, func(t *testing.T) {
+            config := c.config()
+            r, err := c.request()
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            _, data, err := identifierData(r, config)
+            if err != nil {
+                t.Fatalf("identifier not serializable: %v", err)
+            }
+            if data != c.Data {
+                t.Errorf("data\n got %s\nwant %s", data, c.Data)
+            }
+            if key := getCacheKeyWithConfig(r, config); key != c.Key {
+                t.Errorf("key %s, want %s", key, c.Key)
+            }
+        })
+    }
+}
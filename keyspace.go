@@ -0,0 +1,303 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+const (
+    // How often the notification lag probe runs and the flush marker is checked
+    keyspaceProbeInterval = 10 * time.Second
+
+    // The probe and marker keys live outside Cm_Cache's zc:k: namespace, so
+    // Magento never sees them as cache records
+    keyspaceKeyPrefix = "fastfpc:"
+
+    // How long a write-through is expected to take to come back as a notification
+    ownWriteWindow = time.Minute
+)
+
+// Keyspace events that mean a Redis page is gone or was rewritten by someone
+// else. FLUSHDB emits no event, so flushes are detected through a
+// per-process marker key instead.
+var keyspaceEvictEvents = map[string]bool{
+    "del":         true,
+    "expired":     true,
+    "evicted":     true,
+    "hdel":        true,
+    "hset":        true,
+    "rename_from": true,
+}
+
+var keyspace keyspaceStats
+
+// keyspaceStats counts keyspace notification activity; all fields are atomic
+type keyspaceStats struct {
+    Events      int64
+    Evictions   int64
+    Flushes     int64
+    Restarts    int64
+    LastLag     int64 // Nanoseconds between the probe DEL and its notification
+    MaxLag      int64
+    LastEventAt int64 // Unix nanoseconds
+    probeSentAt int64
+}
+
+// keyspaceSnapshot is the JSON form of keyspaceStats
+type keyspaceSnapshot struct {
+    Events    int64   `json:"events"`
+    Evictions int64   `json:"evictions"`
+    Flushes   int64   `json:"flushes"`
+    Restarts  int64   `json:"restarts"`
+    LagMs     float64 `json:"lag_ms"`
+    MaxLagMs  float64 `json:"max_lag_ms"`
+    LastEvent string  `json:"last_event,omitempty"`
+}
+
+func (s *keyspaceStats) snapshot() keyspaceSnapshot {
+    snap := keyspaceSnapshot{
+        Events:    atomic.LoadInt64(&s.Events),
+        Evictions: atomic.LoadInt64(&s.Evictions),
+        Flushes:   atomic.LoadInt64(&s.Flushes),
+        Restarts:  atomic.LoadInt64(&s.Restarts),
+        LagMs:     float64(atomic.LoadInt64(&s.LastLag)) / float64(time.Millisecond),
+        MaxLagMs:  float64(atomic.LoadInt64(&s.MaxLag)) / float64(time.Millisecond),
+    }
+    if last := atomic.LoadInt64(&s.LastEventAt); last > 0 {
+        snap.LastEvent = time.Unix(0, last).Format(time.RFC3339)
+    }
+    return snap
+}
+
+var redisOwnWrites = &ownWrites{keys: make(map[string]ownWrite)}
+
+// ownWrites remembers the pages this process is writing to Redis, so the hset
+// notification of its own write-through does not evict the copy it came from
+type ownWrites struct {
+    mu        sync.Mutex
+    keys      map[string]ownWrite
+    lastSweep time.Time
+}
+
+type ownWrite struct {
+    pending int
+    at      time.Time
+}
+
+// mark records a write of the Redis key about to be sent. Writes whose
+// notification never arrives are dropped once ownWriteWindow has passed.
+func (o *ownWrites) mark(key string) {
+    now := time.Now()
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    w := o.keys[key]
+    w.pending++
+    w.at = now
+    o.keys[key] = w
+
+    if now.Sub(o.lastSweep) < ownWriteWindow {
+        return
+    }
+    o.lastSweep = now
+    for k, w := range o.keys {
+        if now.Sub(w.at) >= ownWriteWindow {
+            delete(o.keys, k)
+        }
+    }
+}
+
+// take reports whether a notification for key is one of our own writes
+func (o *ownWrites) take(key string) bool {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    w, ok := o.keys[key]
+    if !ok {
+        return false
+    }
+    if w.pending--; w.pending > 0 {
+        o.keys[key] = w
+    } else {
+        delete(o.keys, key)
+    }
+    return time.Since(w.at) < ownWriteWindow
+}
+
+// keyspaceKeys names the lag probe and flush marker keys of one process
+func keyspaceKeys(config *CacheConfig, nonce string) (probeKey, markerKey string) {
+    return keyspaceKeyPrefix + "probe:" + config.Prefix + nonce,
+        keyspaceKeyPrefix + "marker:" + config.Prefix + nonce
+}
+
+// watchKeyspace evicts local pages as soon as Redis reports their key deleted,
+// expired or modified, so Magento cache cleans reach the local tier immediately
+func watchKeyspace(config *CacheConfig) {
+    // Notifications are node local, so every cluster master is subscribed
+    masters := redisMasters()
+    if config.KeyspaceConfigure {
+        for _, master := range masters {
+            if err := enableKeyspaceEvents(master); err != nil {
+                warnLog("Cannot enable Redis keyspace notifications: %v\n", err)
+            }
+        }
+    }
+
+    channelPrefix := fmt.Sprintf("__keyspace@%d__:", redisDB(config))
+    nonce := fmt.Sprintf("%d_%d", os.Getpid(), time.Now().UnixNano())
+    probeKey, markerKey := keyspaceKeys(config, nonce)
+    go probeKeyspace(probeKey, markerKey)
+
+    infoLog("Watching Redis keyspace notifications on %s%s* (%d nodes)\n", channelPrefix, prefix, len(masters))
+    for _, master := range masters {
+        go consumeKeyspace(config, master, channelPrefix, probeKey)
+    }
+}
+
+// consumeKeyspace handles the notifications published by one Redis node
+func consumeKeyspace(config *CacheConfig, node redis.UniversalClient, channelPrefix, probeKey string) {
+    pubsub := node.PSubscribe(ctx, channelPrefix+prefix+"*", channelPrefix+probeKey)
+    defer pubsub.Close()
+
+    for msg := range pubsub.Channel() {
+        handleKeyspaceEvent(config, strings.TrimPrefix(msg.Channel, channelPrefix), msg.Payload, probeKey)
+    }
+}
+
+// handleKeyspaceEvent evicts the local copy of the Redis key an event names
+func handleKeyspaceEvent(config *CacheConfig, key, event, probeKey string) {
+    if !keyspaceEvictEvents[event] {
+        return
+    }
+    atomic.AddInt64(&keyspace.Events, 1)
+    atomic.StoreInt64(&keyspace.LastEventAt, time.Now().UnixNano())
+
+    if key == probeKey {
+        recordKeyspaceLag()
+        return
+    }
+    if event == "hset" && redisOwnWrites.take(key) {
+        return
+    }
+
+    cacheKey := strings.TrimPrefix(key, prefix)
+    if localCache.Contains(cacheKey) {
+        atomic.AddInt64(&keyspace.Evictions, 1)
+        if config.Debug {
+            debugLog("🔔 Redis %s %s, evicting local copy\n", event, cacheKey)
+        }
+    }
+    evictLocal(cacheKey)
+    // A page Magento deleted is gone for grace too; one that expired or was
+    // rewritten is kept
+    if event != "expired" && event != "hset" {
+        purgeGrace(nil, cacheKey)
+    }
+}
+
+// enableKeyspaceEvents adds the flags we need to notify-keyspace-events,
+// keeping whatever other subscribers already rely on
+func enableKeyspaceEvents(node redis.UniversalClient) error {
+    current, err := node.ConfigGet(ctx, "notify-keyspace-events").Result()
+    if err != nil {
+        return err
+    }
+    flags := ""
+    if len(current) == 2 {
+        flags, _ = current[1].(string)
+    }
+    for _, flag := range "Kghxe" {
+        if !strings.ContainsRune(flags, flag) && !(strings.ContainsRune(flags, 'A') && flag != 'K') {
+            flags += string(flag)
+        }
+    }
+    return node.ConfigSet(ctx, "notify-keyspace-events", flags).Err()
+}
+
+// probeKeyspace measures notification lag with a throwaway key and watches
+// for a FLUSHDB/FLUSHALL by checking that the marker key still exists. A
+// marker lost together with the server's run id was lost to a restart.
+func probeKeyspace(probeKey, markerKey string) {
+    markerSeen := false
+    runID := ""
+    for range time.Tick(keyspaceProbeInterval) {
+        exists, err := rdb.Exists(ctx, markerKey).Result()
+        if err != nil {
+            continue
+        }
+        id, idErr := redisRunID(markerKey)
+        if exists == 0 && markerSeen {
+            markerLost(idErr == nil && runID != "" && id != runID)
+        }
+        if idErr == nil {
+            runID = id
+        }
+        markerSeen = rdb.Set(ctx, markerKey, 1, 24*time.Hour).Err() == nil
+
+        if err := rdb.Set(ctx, probeKey, 1, time.Minute).Err(); err == nil {
+            atomic.StoreInt64(&keyspace.probeSentAt, time.Now().UnixNano())
+            rdb.Del(ctx, probeKey)
+        }
+    }
+}
+
+// markerLost clears the local tiers after the flush marker disappeared. A
+// FLUSHDB means Magento's cache was cleaned, so every tier goes. A restart
+// only lost Redis' copies, so the disk tier and grace copies are kept.
+func markerLost(restarted bool) {
+    if restarted {
+        atomic.AddInt64(&keyspace.Restarts, 1)
+        flushMemory()
+        warnLog("Redis restarted without its data, memory cache cleared, disk cache kept\n")
+        return
+    }
+    atomic.AddInt64(&keyspace.Flushes, 1)
+    flushLocal()
+    warnLog("Redis database was flushed, local cache cleared\n")
+}
+
+// redisRunID returns the run id of the Redis server holding key
+func redisRunID(key string) (string, error) {
+    var node redis.UniversalClient = rdb
+    if cluster, ok := rdb.(*redis.ClusterClient); ok {
+        master, err := cluster.MasterForKey(ctx, key)
+        if err != nil {
+            return "", err
+        }
+        node = master
+    }
+    info, err := node.Info(ctx, "server").Result()
+    if err != nil {
+        return "", err
+    }
+    return infoField(info, "run_id"), nil
+}
+
+// infoField returns the value of name in INFO output
+func infoField(info, name string) string {
+    for _, line := range strings.Split(info, "\n") {
+        if value := strings.TrimPrefix(line, name+":"); value != line {
+            return strings.TrimSpace(value)
+        }
+    }
+    return ""
+}
+
+func recordKeyspaceLag() {
+    sent := atomic.LoadInt64(&keyspace.probeSentAt)
+    if sent == 0 {
+        return
+    }
+    lag := time.Now().UnixNano() - sent
+    atomic.StoreInt64(&keyspace.LastLag, lag)
+    for {
+        max := atomic.LoadInt64(&keyspace.MaxLag)
+        if lag <= max || atomic.CompareAndSwapInt64(&keyspace.MaxLag, max, lag) {
+            return
+        }
+    }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// useKeyspacePage caches PAGE in memory, grace and on disk
+func useKeyspacePage(t *testing.T) *diskStore {
+    t.Helper()
+    d := useDisk(t)
+    graceCache = newPageCache(0, 0, "lru")
+    entry := CacheEntry{Content: "page PAGE", Created: time.Now()}
+    localCache.Set("PAGE", entry, time.Hour)
+    graceCache.Set("PAGE", entry, time.Hour)
+    writePage(t, d, "PAGE", 0)
+    return d
+}
+
+func TestKeyspaceKeysOutsideCacheNamespace(t *testing.T) {
+    probeKey, markerKey := keyspaceKeys(&CacheConfig{Prefix: "69d_"}, "1_2")
+    for _, key := range []string{probeKey, markerKey} {
+        if strings.HasPrefix(key, corePrefix) {
+            t.Errorf("%s is in Magento's %s namespace", key, corePrefix)
+        }
+        if !strings.Contains(key, "69d_") {
+            t.Errorf("%s does not name the cache prefix", key)
+        }
+    }
+    if probeKey == markerKey {
+        t.Errorf("probe and marker share the key %s", probeKey)
+    }
+}
+
+func TestKeyspaceEventsEvictLocalPages(t *testing.T) {
+    tests := []struct {
+        event     string
+        evicted   bool
+        graceKept bool
+    }{
+        {"del", true, false},
+        {"hdel", true, false},
+        {"evicted", true, false},
+        {"expired", true, true},
+        {"hset", true, true},
+        {"expire", false, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.event, func(t *testing.T) {
+            d := useKeyspacePage(t)
+            handleKeyspaceEvent(loadConfig(), prefix+"PAGE", tt.event, "probe")
+
+            if got := !localCache.Contains("PAGE"); got != tt.evicted {
+                t.Errorf("local copy evicted %v, want %v", got, tt.evicted)
+            }
+            if _, ok := d.graceCopy("PAGE"); ok == tt.evicted {
+                t.Errorf("disk copy kept %v, want %v", ok, !tt.evicted)
+            }
+            if _, ok := graceCache.Get("PAGE"); ok != tt.graceKept {
+                t.Errorf("grace copy kept %v, want %v", ok, tt.graceKept)
+            }
+        })
+    }
+}
+
+func TestKeyspaceKeepsOwnWrites(t *testing.T) {
+    useKeyspacePage(t)
+    redisOwnWrites.mark(prefix + "PAGE")
+
+    handleKeyspaceEvent(loadConfig(), prefix+"PAGE", "hset", "probe")
+    if !localCache.Contains("PAGE") {
+        t.Fatal("own write-through evicted the page it came from")
+    }
+    handleKeyspaceEvent(loadConfig(), prefix+"PAGE", "hset", "probe")
+    if localCache.Contains("PAGE") {
+        t.Error("a second hset, from another writer, kept the local copy")
+    }
+}
+
+func TestOwnWritesExpire(t *testing.T) {
+    o := &ownWrites{keys: map[string]ownWrite{
+        "OLD": {pending: 1, at: time.Now().Add(-2 * ownWriteWindow)},
+    }}
+    if o.take("OLD") {
+        t.Error("a write older than the window matched a notification")
+    }
+
+    o.mark("NEW")
+    if _, ok := o.keys["OLD"]; ok {
+        t.Error("mark did not sweep the stale write")
+    }
+    o.mark("NEW")
+    if !o.take("NEW") || !o.take("NEW") || o.take("NEW") {
+        t.Error("two marks did not match exactly two notifications")
+    }
+}
+
+func TestMarkerLostKeepsDiskOnRestart(t *testing.T) {
+    d := useKeyspacePage(t)
+    restarts, flushes := atomic.LoadInt64(&keyspace.Restarts), atomic.LoadInt64(&keyspace.Flushes)
+
+    markerLost(true)
+    if localCache.Contains("PAGE") {
+        t.Error("memory cache kept after a restart")
+    }
+    if _, ok := d.graceCopy("PAGE"); !ok {
+        t.Error("disk copy removed after a restart")
+    }
+    if _, ok := graceCache.Get("PAGE"); !ok {
+        t.Error("grace copy removed after a restart")
+    }
+
+    markerLost(false)
+    if _, ok := d.graceCopy("PAGE"); ok {
+        t.Error("disk copy kept after a flush")
+    }
+    if _, ok := graceCache.Get("PAGE"); ok {
+        t.Error("grace copy kept after a flush")
+    }
+    if got := atomic.LoadInt64(&keyspace.Restarts) - restarts; got != 1 {
+        t.Errorf("%d restarts counted, want 1", got)
+    }
+    if got := atomic.LoadInt64(&keyspace.Flushes) - flushes; got != 1 {
+        t.Errorf("%d flushes counted, want 1", got)
+    }
+}
+
+func TestInfoField(t *testing.T) {
+    info := "# Server\r\nredis_version:7.2.4\r\nrun_id:8c6a1f0e\r\ntcp_port:6379\r\n"
+    if got := infoField(info, "run_id"); got != "8c6a1f0e" {
+        t.Errorf("run_id %q, want 8c6a1f0e", got)
+    }
+    if got := infoField(info, "run"); got != "" {
+        t.Errorf("prefix of a field matched: %q", got)
+    }
+}
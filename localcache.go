@@ -0,0 +1,492 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Why a page left a pageCache, passed to its onRemoved hook
+type removalReason int
+
+const (
+    removedExpired removalReason = iota // Its TTL ran out
+    removedDeleted                      // Delete was called (purge, keyspace event)
+    removedEvicted                      // Evicted to stay within the memory budget
+)
+
+// Fixed per-entry overhead on top of the page itself: map slot, item, policy
+// bookkeeping and the CacheEntry struct
+const pageItemOverhead = 256
+
+// evictionSampleSize is how many entries are compared when picking a victim
+const evictionSampleSize = 8
+
+// Page size assumed to size the TinyLFU sketch from a byte budget
+const tinyLFUPageSize = 16 << 10
+
+// pageStore is what the local and grace tiers need from an in-memory store
+type pageStore interface {
+    Get(key string) (CacheEntry, bool)
+    Contains(key string) bool
+    Set(key string, entry CacheEntry, ttl time.Duration) bool
+    Delete(key string)
+    Flush()
+    Items() map[string]pageCacheItem
+    setOnRemoved(fn func(key string, entry CacheEntry, reason removalReason))
+    setStaleCopy(fn func(entry CacheEntry) (CacheEntry, time.Duration, bool))
+    startJanitor(interval time.Duration)
+    snapshot() pageCacheSnapshot
+}
+
+// pageCache is one in-memory store: CacheEntry values with a TTL, kept within
+// a byte budget and an optional entry count by an eviction policy. Hits only
+// take the read lock; recency and frequency are updated atomically and
+// eviction samples a few entries instead of keeping them in order, like Redis.
+type pageCache struct {
+    hits, misses, expirations, evictions, rejections int64
+
+    mu         sync.RWMutex
+    items      map[string]*pageItem
+    policy     evictionPolicy
+    policyName string
+    admission  *tinyLFU // nil unless CACHE_EVICTION=tinylfu
+    bytes      int64
+    maxBytes   int64 // 0 means unlimited
+    maxEntries int   // 0 means unlimited
+
+    // onRemoved runs outside the lock for expired, deleted and evicted
+    // entries, so it may Set the key again
+    onRemoved func(key string, entry CacheEntry, reason removalReason)
+
+    // staleCopy runs under the lock when an entry expires; a copy it returns
+    // replaces the entry for the returned TTL, so a page stored meanwhile
+    // cannot be overwritten by the old one
+    staleCopy func(entry CacheEntry) (CacheEntry, time.Duration, bool)
+}
+
+type pageItem struct {
+    access  int64  // Unix nanoseconds of the last hit, updated atomically
+    freq    uint32 // Hits, updated atomically and halved by the janitor
+    key     string
+    entry   CacheEntry
+    size    int64
+    expires int64 // Unix nanoseconds, 0 never
+}
+
+// pageCacheItem is one entry as Items returns it
+type pageCacheItem struct {
+    Entry      CacheEntry
+    Expiration int64
+}
+
+// pageCacheSnapshot is the JSON form of pageCache statistics
+type pageCacheSnapshot struct {
+    Policy      string `json:"policy"`
+    Shards      int    `json:"shards,omitempty"`
+    Entries     int    `json:"entries"`
+    Bytes       int64  `json:"bytes"`
+    MaxBytes    int64  `json:"max_bytes"`
+    MaxEntries  int    `json:"max_entries"`
+    Hits        int64  `json:"hits"`
+    Misses      int64  `json:"misses"`
+    Expirations int64  `json:"expirations"`
+    Evictions   int64  `json:"evictions"`
+    Rejections  int64  `json:"rejections"`
+}
+
+// evictionPolicy reports whether a should be evicted before b
+type evictionPolicy func(a, b *pageItem) bool
+
+// lruFirst evicts the least recently used entry
+func lruFirst(a, b *pageItem) bool {
+    return atomic.LoadInt64(&a.access) < atomic.LoadInt64(&b.access)
+}
+
+// lfuFirst evicts the least frequently used entry, the older one on a tie
+func lfuFirst(a, b *pageItem) bool {
+    fa, fb := atomic.LoadUint32(&a.freq), atomic.LoadUint32(&b.freq)
+    if fa != fb {
+        return fa < fb
+    }
+    return lruFirst(a, b)
+}
+
+// newPageCache creates a cache evicting by policy: "lru", "lfu" or
+// "tinylfu" (LRU eviction behind a TinyLFU admission filter)
+func newPageCache(maxBytes int64, maxEntries int, policy string) *pageCache {
+    c := &pageCache{
+        items:      make(map[string]*pageItem),
+        maxBytes:   maxBytes,
+        maxEntries: maxEntries,
+    }
+    switch policy {
+    case "lfu":
+        c.policy = lfuFirst
+    case "tinylfu":
+        c.policy = lruFirst
+        c.admission = newTinyLFU(expectedEntries(maxBytes, maxEntries))
+    default:
+        if policy != "lru" {
+            warnLog("Warning: unknown CACHE_EVICTION %q, using lru\n", policy)
+            policy = "lru"
+        }
+        c.policy = lruFirst
+    }
+    c.policyName = policy
+    return c
+}
+
+func (c *pageCache) setOnRemoved(fn func(key string, entry CacheEntry, reason removalReason)) {
+    c.onRemoved = fn
+}
+
+func (c *pageCache) setStaleCopy(fn func(entry CacheEntry) (CacheEntry, time.Duration, bool)) {
+    c.staleCopy = fn
+}
+
+// startJanitor removes expired entries every interval, so their memory is
+// returned even when nobody asks for them again
+func (c *pageCache) startJanitor(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            c.deleteExpired()
+        }
+    }()
+}
+
+// Get returns the entry of key. An expired entry is replaced by its stale
+// copy, which is then returned, or removed.
+func (c *pageCache) Get(key string) (CacheEntry, bool) {
+    if c.admission != nil {
+        c.admission.record(key)
+    }
+    for attempt := 0; attempt < 2; attempt++ {
+        now := time.Now().UnixNano()
+        c.mu.RLock()
+        it, ok := c.items[key]
+        if ok && (it.expires == 0 || now < it.expires) {
+            atomic.StoreInt64(&it.access, now)
+            atomic.AddUint32(&it.freq, 1)
+            entry := it.entry
+            c.mu.RUnlock()
+            atomic.AddInt64(&c.hits, 1)
+            return entry, true
+        }
+        c.mu.RUnlock()
+        if !ok {
+            break
+        }
+
+        // Expired: replace or remove it unless another caller already did
+        c.mu.Lock()
+        removed := false
+        if current, ok := c.items[key]; ok && current == it {
+            removed = c.expireLocked(it, now)
+        }
+        c.mu.Unlock()
+        if removed {
+            c.removed(it, removedExpired)
+        }
+    }
+    atomic.AddInt64(&c.misses, 1)
+    return CacheEntry{}, false
+}
+
+// Contains reports whether key has an unexpired entry, without counting a
+// lookup or touching its recency
+func (c *pageCache) Contains(key string) bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    it, ok := c.items[key]
+    return ok && (it.expires == 0 || time.Now().UnixNano() < it.expires)
+}
+
+// Set stores entry for ttl (0 never expires). It returns false when the entry
+// is larger than the budget or TinyLFU judged it less popular than the victim.
+func (c *pageCache) Set(key string, entry CacheEntry, ttl time.Duration) bool {
+    now := time.Now()
+    it := &pageItem{key: key, entry: entry, size: entrySize(key, entry), access: now.UnixNano(), freq: 1}
+    if ttl > 0 {
+        it.expires = now.Add(ttl).UnixNano()
+    }
+
+    c.mu.Lock()
+    if c.maxBytes > 0 && it.size > c.maxBytes {
+        // An older, smaller version must not outlive the new one
+        old, ok := c.items[key]
+        if ok {
+            c.removeLocked(old)
+        }
+        c.rejections++
+        c.mu.Unlock()
+        if ok {
+            c.removed(old, removedEvicted)
+        }
+        return false
+    }
+    if old, ok := c.items[key]; ok {
+        it.freq = atomic.LoadUint32(&old.freq)
+        c.removeLocked(old)
+    } else if c.admission != nil && c.overBudget(it.size) {
+        if victim := c.victimLocked(); victim != nil && !c.admission.admit(key, victim.key) {
+            c.rejections++
+            c.mu.Unlock()
+            return false
+        }
+    }
+
+    var evicted []*pageItem
+    for c.overBudget(it.size) {
+        victim := c.victimLocked()
+        if victim == nil {
+            break
+        }
+        c.removeLocked(victim)
+        c.evictions++
+        evicted = append(evicted, victim)
+    }
+    c.items[key] = it
+    c.bytes += it.size
+    c.mu.Unlock()
+
+    for _, victim := range evicted {
+        c.removed(victim, removedEvicted)
+    }
+    return true
+}
+
+// Delete removes key and runs onRemoved with removedDeleted
+func (c *pageCache) Delete(key string) {
+    c.mu.Lock()
+    it, ok := c.items[key]
+    if ok {
+        c.removeLocked(it)
+    }
+    c.mu.Unlock()
+    if ok {
+        c.removed(it, removedDeleted)
+    }
+}
+
+// Flush drops every entry without running onRemoved
+func (c *pageCache) Flush() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.items = make(map[string]*pageItem)
+    c.bytes = 0
+}
+
+// Items returns a copy of the unexpired entries
+func (c *pageCache) Items() map[string]pageCacheItem {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    now := time.Now().UnixNano()
+    items := make(map[string]pageCacheItem, len(c.items))
+    for key, it := range c.items {
+        if it.expires == 0 || now < it.expires {
+            items[key] = pageCacheItem{Entry: it.entry, Expiration: it.expires}
+        }
+    }
+    return items
+}
+
+func (c *pageCache) deleteExpired() {
+    now := time.Now().UnixNano()
+    var expired []*pageItem
+    c.mu.Lock()
+    for _, it := range c.items {
+        if it.expires > 0 && now >= it.expires {
+            if c.expireLocked(it, now) {
+                expired = append(expired, it)
+            }
+        } else {
+            // Age frequencies so pages popular long ago can be evicted
+            atomic.StoreUint32(&it.freq, atomic.LoadUint32(&it.freq)/2)
+        }
+    }
+    c.mu.Unlock()
+
+    for _, it := range expired {
+        c.removed(it, removedExpired)
+    }
+}
+
+// overBudget reports whether adding an entry of size bytes exceeds a limit
+func (c *pageCache) overBudget(size int64) bool {
+    if len(c.items) == 0 {
+        return false
+    }
+    return c.maxBytes > 0 && c.bytes+size > c.maxBytes ||
+        c.maxEntries > 0 && len(c.items)+1 > c.maxEntries
+}
+
+// victimLocked picks the entry to evict among a few sampled ones. Map
+// iteration starts at a random position, which makes the sample random.
+func (c *pageCache) victimLocked() *pageItem {
+    var victim *pageItem
+    sampled := 0
+    for _, it := range c.items {
+        if victim == nil || c.policy(it, victim) {
+            victim = it
+        }
+        if sampled++; sampled >= evictionSampleSize {
+            break
+        }
+    }
+    return victim
+}
+
+// expireLocked replaces the expired it by its stale copy or removes it, and
+// reports whether it was removed
+func (c *pageCache) expireLocked(it *pageItem, now int64) bool {
+    c.expirations++
+    if c.staleCopy != nil {
+        if entry, ttl, ok := c.staleCopy(it.entry); ok && ttl > 0 {
+            stale := &pageItem{key: it.key, entry: entry, size: entrySize(it.key, entry), access: atomic.LoadInt64(&it.access),
+                freq: atomic.LoadUint32(&it.freq), expires: now + int64(ttl)}
+            c.items[it.key] = stale
+            c.bytes += stale.size - it.size
+            return false
+        }
+    }
+    c.removeLocked(it)
+    return true
+}
+
+func (c *pageCache) removeLocked(it *pageItem) {
+    delete(c.items, it.key)
+    c.bytes -= it.size
+}
+
+func (c *pageCache) removed(it *pageItem, reason removalReason) {
+    if c.onRemoved != nil {
+        c.onRemoved(it.key, it.entry, reason)
+    }
+}
+
+func (c *pageCache) snapshot() pageCacheSnapshot {
+    c.mu.RLock()
+    entries, bytes := len(c.items), c.bytes
+    expirations, evictions, rejections := c.expirations, c.evictions, c.rejections
+    c.mu.RUnlock()
+    return pageCacheSnapshot{
+        Policy:      c.policyName,
+        Entries:     entries,
+        Bytes:       bytes,
+        MaxBytes:    c.maxBytes,
+        MaxEntries:  c.maxEntries,
+        Hits:        atomic.LoadInt64(&c.hits),
+        Misses:      atomic.LoadInt64(&c.misses),
+        Expirations: expirations,
+        Evictions:   evictions,
+        Rejections:  rejections,
+    }
+}
+
+// entrySize estimates the memory an entry holds
+func entrySize(key string, entry CacheEntry) int64 {
+    size := int64(pageItemOverhead + len(key) + len(entry.Content) + len(entry.NoStore))
+    for name, values := range entry.Headers {
+        size += int64(len(name))
+        for _, value := range values {
+            size += int64(len(value) + 16)
+        }
+    }
+    for _, tag := range entry.Tags {
+        size += int64(len(tag) + 16)
+    }
+    return size
+}
+
+// hashKey is FNV-1a over key without allocating
+func hashKey(key string) uint64 {
+    h := uint64(14695981039346656037)
+    for i := 0; i < len(key); i++ {
+        h ^= uint64(key[i])
+        h *= 1099511628211
+    }
+    return h
+}
+
+// tinyLFU is an admission filter: a count-min sketch of recent key
+// popularity that only lets a new entry in when it is asked for more often
+// than the one it would evict. Counters are halved every resetAfter records.
+// Counts are updated atomically, so hits need no lock; a lost update only
+// makes the estimate a little lower.
+type tinyLFU struct {
+    rows       [4][]uint32
+    mask       uint64
+    records    int64
+    resetAfter int64
+}
+
+// expectedEntries estimates how many pages a store holds, to size its sketch
+func expectedEntries(maxBytes int64, maxEntries int) int {
+    switch {
+    case maxEntries > 0:
+        return maxEntries
+    case maxBytes > 0:
+        return int(maxBytes / tinyLFUPageSize)
+    }
+    return 1 << 14
+}
+
+func newTinyLFU(expectedEntries int) *tinyLFU {
+    width := 1 << 8
+    for width < expectedEntries {
+        width <<= 1
+    }
+    t := &tinyLFU{mask: uint64(width - 1), resetAfter: int64(10 * width)}
+    for i := range t.rows {
+        t.rows[i] = make([]uint32, width)
+    }
+    return t
+}
+
+func (t *tinyLFU) indexes(key string) [4]uint64 {
+    sum := hashKey(key)
+    lo, hi := sum&0xffffffff, sum>>32
+    var idx [4]uint64
+    for i := range idx {
+        idx[i] = (lo + uint64(i)*hi) & t.mask
+    }
+    return idx
+}
+
+func (t *tinyLFU) record(key string) {
+    for i, j := range t.indexes(key) {
+        if atomic.LoadUint32(&t.rows[i][j]) < 15 {
+            atomic.AddUint32(&t.rows[i][j], 1)
+        }
+    }
+    if atomic.AddInt64(&t.records, 1)%t.resetAfter == 0 {
+        for i := range t.rows {
+            for j := range t.rows[i] {
+                atomic.StoreUint32(&t.rows[i][j], atomic.LoadUint32(&t.rows[i][j])/2)
+            }
+        }
+    }
+}
+
+func (t *tinyLFU) estimate(key string) uint32 {
+    min := uint32(1 << 31)
+    for i, j := range t.indexes(key) {
+        if v := atomic.LoadUint32(&t.rows[i][j]); v < min {
+            min = v
+        }
+    }
+    return min
+}
+
+func (t *tinyLFU) admit(candidate, victim string) bool {
+    return t.estimate(candidate) > t.estimate(victim)
+}
+
+// localSnapshot reports the local tier, empty when it is not used
+func localSnapshot() pageCacheSnapshot {
+    if localCache == nil {
+        return pageCacheSnapshot{}
+    }
+    return localCache.snapshot()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// page returns an entry whose size is exactly size bytes for a 1 byte key
+func page(size int) CacheEntry {
+    return CacheEntry{Content: strings.Repeat("x", size-pageItemOverhead-1)}
+}
+
+func TestPageCacheByteBudget(t *testing.T) {
+    c := newPageCache(3000, 0, "lru")
+    for _, key := range []string{"a", "b", "c"} {
+        if !c.Set(key, page(1000), time.Hour) {
+            t.Fatalf("Set(%s) rejected within budget", key)
+        }
+        time.Sleep(time.Millisecond)
+    }
+    c.Set("d", page(1000), time.Hour)
+    s := c.snapshot()
+    if s.Entries != 3 || s.Bytes != 3000 || s.Evictions != 1 {
+        t.Errorf("after overflow %+v, want 3 entries, 3000 bytes, 1 eviction", s)
+    }
+    if c.Contains("a") {
+        t.Error("oldest page survived the overflow")
+    }
+
+    // A page larger than the whole budget is refused and its old version dropped
+    if c.Set("b", page(4000), time.Hour) {
+        t.Error("page larger than the budget stored")
+    }
+    if c.Contains("b") {
+        t.Error("older version outlived the refused page")
+    }
+    if s := c.snapshot(); s.Rejections != 1 || s.Bytes != 2000 {
+        t.Errorf("after oversized page %+v, want 1 rejection and 2000 bytes", s)
+    }
+
+    // Replacing a page accounts the difference only
+    c.Set("c", page(500), time.Hour)
+    if s := c.snapshot(); s.Bytes != 1500 || s.Entries != 2 {
+        t.Errorf("after replace %+v, want 2 entries and 1500 bytes", s)
+    }
+}
+
+func TestPageCacheMaxEntries(t *testing.T) {
+    c := newPageCache(0, 2, "lru")
+    for _, key := range []string{"a", "b", "c"} {
+        c.Set(key, page(1000), time.Hour)
+        time.Sleep(time.Millisecond)
+    }
+    if s := c.snapshot(); s.Entries != 2 || s.Evictions != 1 {
+        t.Errorf("%+v, want 2 entries after 1 eviction", s)
+    }
+    c.Set("c", page(1000), time.Hour)
+    if s := c.snapshot(); s.Entries != 2 || s.Evictions != 1 {
+        t.Errorf("replacing a page evicted another: %+v", s)
+    }
+}
+
+func TestPageCacheEvictionPolicies(t *testing.T) {
+    tests := []struct {
+        policy string
+        hits   map[string]int
+        victim string
+    }{
+        // Only b is read after being stored, a is the oldest
+        {"lru", map[string]int{"b": 1}, "a"},
+        {"lfu", map[string]int{"a": 3, "c": 2, "b": 1}, "b"},
+        {"lfu", map[string]int{"b": 3, "c": 2, "a": 1}, "a"},
+    }
+    for _, tt := range tests {
+        c := newPageCache(0, 3, tt.policy)
+        for _, key := range []string{"a", "b", "c"} {
+            c.Set(key, page(1000), time.Hour)
+            time.Sleep(time.Millisecond)
+        }
+        for _, key := range []string{"c", "b", "a"} {
+            for i := 0; i < tt.hits[key]; i++ {
+                c.Get(key)
+            }
+            time.Sleep(time.Millisecond)
+        }
+        c.Set("d", page(1000), time.Hour)
+        for _, key := range []string{"a", "b", "c", "d"} {
+            if want := key != tt.victim; c.Contains(key) != want {
+                t.Errorf("%s with hits %v: %s cached %v, want %v", tt.policy, tt.hits, key, !want, want)
+            }
+        }
+    }
+}
+
+func TestPageCacheTinyLFUAdmission(t *testing.T) {
+    c := newPageCache(0, 2, "tinylfu")
+    c.Set("a", page(1000), time.Hour)
+    c.Set("b", page(1000), time.Hour)
+    for i := 0; i < 2; i++ {
+        c.Get("a")
+        c.Get("b")
+    }
+
+    // Never requested: less popular than any victim
+    if c.Set("once", page(1000), time.Hour) {
+        t.Error("page nobody asked for was admitted")
+    }
+    if s := c.snapshot(); s.Rejections != 1 || s.Entries != 2 {
+        t.Errorf("%+v, want 1 rejection and both pages kept", s)
+    }
+
+    // Requested more often than the pages it replaces
+    for i := 0; i < 5; i++ {
+        c.Get("hot")
+    }
+    if !c.Set("hot", page(1000), time.Hour) || !c.Contains("hot") {
+        t.Error("popular page refused")
+    }
+    if s := c.snapshot(); s.Entries != 2 || s.Evictions != 1 {
+        t.Errorf("%+v, want 2 entries after 1 eviction", s)
+    }
+}
+
+// staleOnce keeps an expired entry once for ttl
+func staleOnce(ttl time.Duration) func(entry CacheEntry) (CacheEntry, time.Duration, bool) {
+    return func(entry CacheEntry) (CacheEntry, time.Duration, bool) {
+        if entry.Expired {
+            return entry, 0, false
+        }
+        entry.Expired = true
+        return entry, ttl, true
+    }
+}
+
+func TestPageCacheStaleCopy(t *testing.T) {
+    c := newPageCache(0, 0, "lru")
+    c.setStaleCopy(staleOnce(time.Hour))
+    var removed []string
+    c.setOnRemoved(func(key string, entry CacheEntry, reason removalReason) {
+        removed = append(removed, key)
+    })
+
+    c.Set("get", CacheEntry{Content: "old"}, time.Millisecond)
+    c.Set("janitor", CacheEntry{Content: "old"}, time.Millisecond)
+    time.Sleep(2 * time.Millisecond)
+
+    if entry, ok := c.Get("get"); !ok || !entry.Expired || entry.Content != "old" {
+        t.Errorf("Get of an expired page = %+v, %v; want its stale copy", entry, ok)
+    }
+    c.deleteExpired()
+    if !c.Contains("janitor") {
+        t.Error("janitor dropped the page instead of keeping it stale")
+    }
+    if len(removed) != 0 {
+        t.Errorf("onRemoved ran for %v, stale copies are not removals", removed)
+    }
+
+    // A page stored after the stale copy replaces it for good
+    c.Set("get", CacheEntry{Content: "new"}, time.Hour)
+    c.deleteExpired()
+    if entry, _ := c.Get("get"); entry.Content != "new" || entry.Expired {
+        t.Errorf("fresh page replaced by %+v", entry)
+    }
+
+    // A stale copy that expires is removed
+    c.setStaleCopy(staleOnce(time.Millisecond))
+    c.Set("short", CacheEntry{Content: "old"}, time.Millisecond)
+    time.Sleep(2 * time.Millisecond)
+    c.deleteExpired()
+    time.Sleep(2 * time.Millisecond)
+    if _, ok := c.Get("short"); ok {
+        t.Error("stale copy outlived its own TTL")
+    }
+    if len(removed) != 1 || removed[0] != "short" {
+        t.Errorf("onRemoved ran for %v, want [short]", removed)
+    }
+}
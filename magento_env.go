@@ -0,0 +1,143 @@
+package main
+
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// Page cache backends that store pages in the Cm_Cache Redis layout
+var magentoRedisBackends = map[string]bool{
+    "cm_cache_backend_redis":                 true,
+    "magento\\framework\\cache\\backend\\redis": true,
+}
+
+// applyMagentoEnv reads the page cache settings from <MAGENTO_ROOT>/app/etc/env.php
+// and exports them as the matching environment variables, unless the variable
+// is already set. loadConfig then picks them up like any other setting, so
+// explicit env vars and .env entries keep overriding Magento's file.
+func applyMagentoEnv(root string) {
+    if root == "" {
+        return
+    }
+
+    settings, err := readMagentoEnv(root)
+    if err != nil {
+        warnLog("Warning: cannot read Magento configuration from %s: %v\n", root, err)
+        return
+    }
+
+    var applied, overridden []string
+    for name, value := range settings {
+        if os.Getenv(name) != "" {
+            overridden = append(overridden, name)
+            continue
+        }
+        os.Setenv(name, value)
+        applied = append(applied, name)
+    }
+    sort.Strings(applied)
+    sort.Strings(overridden)
+
+    infoLog("Magento env.php: using %s\n", strings.Join(applied, ", "))
+    if len(overridden) > 0 {
+        infoLog("Magento env.php: overridden by environment %s\n", strings.Join(overridden, ", "))
+    }
+}
+
+// readMagentoEnv maps the page_cache frontend of env.php to FPC variable names
+func readMagentoEnv(root string) (map[string]string, error) {
+    path := filepath.Join(root, "app", "etc", "env.php")
+    src, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    env, err := parsePHPReturnArray(string(src))
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+
+    pageCache, ok := env.lookup("cache", "frontend", "page_cache").(phpArray)
+    if !ok {
+        return nil, fmt.Errorf("%s has no cache/frontend/page_cache section, the page cache is not in Redis", path)
+    }
+    if backend := phpString(pageCache["backend"]); !magentoRedisBackends[strings.ToLower(strings.TrimPrefix(backend, "\\"))] {
+        return nil, fmt.Errorf("page_cache backend %q is not Cm_Cache_Backend_Redis", backend)
+    }
+
+    settings := make(map[string]string)
+    options, _ := pageCache["backend_options"].(phpArray)
+    setting := func(name, option string) {
+        if value := phpString(options[option]); value != "" {
+            settings[name] = value
+        }
+    }
+
+    setting("REDIS_PORT", "port")
+    setting("REDIS_DB", "database")
+    setting("REDIS_USERNAME", "username")
+    setting("REDIS_PASSWORD", "password")
+    setting("COMPRESS_DATA", "compress_data")
+    setting("COMPRESS_TAGS", "compress_tags")
+    setting("COMPRESS_THRESHOLD", "compress_threshold")
+    setting("COMPRESSION_LIB", "compression_lib")
+
+    // Credis accepts tcp://, tls:// and unix socket paths in "server"; with
+    // sentinel_master it is a comma separated list of sentinels instead
+    server := phpString(options["server"])
+    if strings.Contains(server, "tls://") {
+        settings["REDIS_TLS"] = "true"
+    }
+    if master := phpString(options["sentinel_master"]); master != "" {
+        var sentinels []string
+        for _, addr := range strings.Split(server, ",") {
+            if addr = stripRedisScheme(strings.TrimSpace(addr)); addr != "" {
+                sentinels = append(sentinels, addr)
+            }
+        }
+        settings["REDIS_MODE"] = redisModeSentinel
+        settings["REDIS_SENTINEL_MASTER"] = master
+        settings["REDIS_ADDRS"] = strings.Join(sentinels, ",")
+    } else if server != "" {
+        settings["REDIS_HOST"] = stripRedisScheme(server)
+    }
+
+    // Since 2.4.7 the vary string is salted with the crypt key
+    if key := phpString(env.lookup("crypt", "key")); key != "" {
+        settings["CRYPT_KEY"] = key
+    }
+
+    // Magento falls back to a prefix derived from the app/etc path when
+    // id_prefix is not configured, see Magento\Framework\App\Cache\Frontend\Factory
+    if idPrefix := phpString(pageCache["id_prefix"]); idPrefix != "" {
+        settings["PREFIX"] = idPrefix
+    } else {
+        settings["PREFIX"] = magentoDefaultPrefix(root)
+    }
+
+    return settings, nil
+}
+
+// stripRedisScheme removes the Credis tcp:// or tls:// scheme
+func stripRedisScheme(server string) string {
+    for _, scheme := range []string{"tcp://", "tls://", "unix://"} {
+        server = strings.TrimPrefix(server, scheme)
+    }
+    return server
+}
+
+// magentoDefaultPrefix is substr(md5(<root>/app/etc/), 0, 3) . '_'
+func magentoDefaultPrefix(root string) string {
+    if resolved, err := filepath.EvalSymlinks(root); err == nil {
+        root = resolved
+    }
+    if abs, err := filepath.Abs(root); err == nil {
+        root = abs
+    }
+    sum := md5.Sum([]byte(filepath.ToSlash(filepath.Join(root, "app", "etc")) + "/"))
+    return hex.EncodeToString(sum[:])[:3] + "_"
+}
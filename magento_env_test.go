@@ -0,0 +1,102 @@
+package main
+
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestReadMagentoEnv(t *testing.T) {
+    settings, err := readMagentoEnv("testdata/magento")
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]string{
+        "REDIS_HOST":      "redis-fpc",
+        "REDIS_PORT":      "6380",
+        "REDIS_DB":        "1",
+        "COMPRESS_DATA":   "0",
+        "COMPRESS_TAGS":   "1",
+        "COMPRESSION_LIB": "gzip",
+        "PREFIX":          "40d_",
+        "CRYPT_KEY":       "base64Yk5HQ0Zyd2lFR0xZWFRhT0JzR2tGeG1JUkdPc1p5cWE=",
+    }
+    if !reflect.DeepEqual(settings, want) {
+        t.Errorf("got %v\nwant %v", settings, want)
+    }
+
+    env, err := os.ReadFile("testdata/magento/app/etc/env.php")
+    if err != nil {
+        t.Fatal(err)
+    }
+    parsed, err := parsePHPReturnArray(string(env))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := parsed.lookup("db", "connection", "default", "password"); got != `it's "secret"` {
+        t.Errorf("db password %q", got)
+    }
+    if got := parsed.lookup("db", "connection", "default", "driver_options", "1014"); got != false {
+        t.Errorf("driver option 1014 = %#v, want false", got)
+    }
+    if got := parsed.lookup("cache", "allow_parallel_generation"); got != false {
+        t.Errorf("commented out entry was parsed, allow_parallel_generation = %#v", got)
+    }
+}
+
+// Without id_prefix Magento uses substr(md5(<root>/app/etc/), 0, 3) . '_'
+func TestReadMagentoEnvDefaultPrefix(t *testing.T) {
+    root := filepath.Join(t.TempDir(), "var", "www", "magento")
+    if err := os.MkdirAll(filepath.Join(root, "app", "etc"), 0o755); err != nil {
+        t.Fatal(err)
+    }
+    env := `<?php
+return array(
+    'cache' => array(
+        'frontend' => array(
+            'page_cache' => array(
+                'backend' => '\Cm_Cache_Backend_Redis',
+                'backend_options' => array('server' => '/var/run/redis.sock', 'database' => 3),
+            ),
+        ),
+    ),
+);
+`
+    if err := os.WriteFile(filepath.Join(root, "app", "etc", "env.php"), []byte(env), 0o644); err != nil {
+        t.Fatal(err)
+    }
+
+    settings, err := readMagentoEnv(root)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if settings["REDIS_HOST"] != "/var/run/redis.sock" || settings["REDIS_DB"] != "3" {
+        t.Errorf("redis settings %v", settings)
+    }
+    resolved, err := filepath.EvalSymlinks(root)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sum := md5.Sum([]byte(resolved + "/app/etc/"))
+    if got, want := settings["PREFIX"], hex.EncodeToString(sum[:])[:3]+"_"; got != want {
+        t.Errorf("PREFIX %q, want %q", got, want)
+    }
+
+    if got := magentoDefaultPrefix("/var/www/html"); got != "792_" {
+        t.Errorf("prefix for /var/www/html %q, want 792_", got)
+    }
+}
+
+func TestReadMagentoEnvRejectsOtherBackends(t *testing.T) {
+    root := t.TempDir()
+    os.MkdirAll(filepath.Join(root, "app", "etc"), 0o755)
+    env := `<?php return ['cache' => ['frontend' => ['page_cache' => ['backend' => 'Cm_Cache_Backend_File']]]];`
+    os.WriteFile(filepath.Join(root, "app", "etc", "env.php"), []byte(env), 0o644)
+
+    if settings, err := readMagentoEnv(root); err == nil {
+        t.Errorf("file backend accepted: %v", settings)
+    }
+}
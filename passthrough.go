@@ -0,0 +1,55 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httputil"
+    "time"
+)
+
+type proxyStartKey struct{}
+
+// passThrough forwards requests that are never cached (POSTs, checkout,
+// customer, admin) unchanged: full URL, streamed bodies, every header and the
+// backend's own status, redirects and cookies
+var passThrough = &httputil.ReverseProxy{
+    Director:       directPassThrough,
+    Transport:      httpClient.Transport,
+    FlushInterval:  -1, // Flush as the backend writes, for streamed exports and SSE
+    ModifyResponse: markPassThrough,
+    ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+        errorLog("Proxy error: %v\n", err)
+        w.WriteHeader(http.StatusBadGateway)
+    },
+}
+
+// proxyPassThrough sends r to the backend through passThrough
+func proxyPassThrough(w http.ResponseWriter, r *http.Request) {
+    r = r.WithContext(context.WithValue(r.Context(), proxyStartKey{}, time.Now()))
+    passThrough.ServeHTTP(w, r)
+}
+
+// directPassThrough points the outgoing request at the backend. The inbound
+// X-Forwarded-* headers are kept so Magento still sees the client's scheme,
+// and ReverseProxy appends the client address to X-Forwarded-For.
+func directPassThrough(out *http.Request) {
+    config := loadConfig()
+    out.URL.Scheme = "http"
+    if config.UseHTTPS {
+        out.URL.Scheme = "https"
+    }
+    out.URL.Host = config.Host
+    if !config.PreserveHost {
+        // An empty Host makes the transport send the backend's
+        out.Host = ""
+    }
+}
+
+// markPassThrough adds the proxy timing, like cached responses carry theirs
+func markPassThrough(resp *http.Response) error {
+    if start, ok := resp.Request.Context().Value(proxyStartKey{}).(time.Time); ok {
+        resp.Header.Set("X-Proxy-Time", fmt.Sprintf("%.2fms", time.Since(start).Seconds()*1000))
+    }
+    return nil
+}
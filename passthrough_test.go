@@ -0,0 +1,89 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+)
+
+func TestPassThroughForwardsPostBodies(t *testing.T) {
+    calls := useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+        io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+    })
+
+    for n := 1; n <= 2; n++ {
+        req := httptest.NewRequest(http.MethodPost, "http://shop.example/checkout/cart/add?product=5", strings.NewReader("qty=2&form_key=abc"))
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        rec := httptest.NewRecorder()
+        handleRequest(rec, req)
+
+        if got := rec.Body.String(); got != "POST /checkout/cart/add?product=5 qty=2&form_key=abc" {
+            t.Errorf("request %d: backend saw %q", n, got)
+        }
+        if got := rec.Header().Get("Content-Type"); got != "application/x-www-form-urlencoded" {
+            t.Errorf("request %d: Content-Type %q, want the request's echoed back", n, got)
+        }
+        if got := rec.Header().Get("Fast-Cache"); got != "" {
+            t.Errorf("request %d: POST answered from cache (Fast-Cache: %s)", n, got)
+        }
+    }
+    if got := atomic.LoadInt64(calls); got != 2 {
+        t.Errorf("backend called %d times, want every POST", got)
+    }
+}
+
+func TestPassThroughKeepsResponseUnchanged(t *testing.T) {
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Add("Set-Cookie", "PHPSESSID=abc; path=/; HttpOnly")
+        w.Header().Add("Set-Cookie", "form_key=def; path=/")
+        w.Header().Add("Set-Cookie", "private_content_version=ghi; path=/")
+        w.Header().Set("Location", "/checkout/cart/")
+        w.WriteHeader(http.StatusFound)
+    })
+
+    rec := httptest.NewRecorder()
+    handleRequest(rec, httptest.NewRequest(http.MethodPost, "http://shop.example/checkout/cart/add", strings.NewReader("qty=1")))
+
+    // The redirect reaches the client instead of being followed
+    if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/checkout/cart/" {
+        t.Errorf("got %d to %q, want 302 to /checkout/cart/", rec.Code, rec.Header().Get("Location"))
+    }
+    if got := rec.Header().Values("Set-Cookie"); len(got) != 3 || !strings.HasPrefix(got[2], "private_content_version=") {
+        t.Errorf("Set-Cookie %q, want all 3 cookies in order", got)
+    }
+    if rec.Header().Get("X-Proxy-Time") == "" {
+        t.Error("no X-Proxy-Time on a pass-through response")
+    }
+}
+
+func TestPassThroughForwardsClientAddress(t *testing.T) {
+    var forwarded, proto, host string
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        forwarded, proto, host = r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), r.Host
+    })
+
+    for _, preserve := range []bool{false, true} {
+        loadConfig().PreserveHost = preserve
+        req := httptest.NewRequest(http.MethodPost, "http://shop.example/customer/account/loginPost", nil)
+        req.RemoteAddr = "203.0.113.5:40000"
+        req.Header.Set("X-Forwarded-For", "198.51.100.1")
+        req.Header.Set("X-Forwarded-Proto", "https")
+        handleRequest(httptest.NewRecorder(), req)
+
+        if forwarded != "198.51.100.1, 203.0.113.5" {
+            t.Errorf("X-Forwarded-For %q, want the client appended", forwarded)
+        }
+        if proto != "https" {
+            t.Errorf("X-Forwarded-Proto %q, want the inbound https kept", proto)
+        }
+        if (host == "shop.example") != preserve {
+            t.Errorf("PRESERVE_HOST=%v: backend saw Host %q", preserve, host)
+        }
+    }
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// phpArray is a decoded PHP array; integer keys are stored as decimal strings
+type phpArray map[string]interface{}
+
+// parsePHPReturnArray evaluates files like app/etc/env.php that consist of a
+// single `return [...]` of literals. Anything dynamic (constants, function
+// calls, variables) is rejected instead of being guessed.
+func parsePHPReturnArray(src string) (phpArray, error) {
+    p := &phpParser{src: src}
+    p.skipOpenTag()
+
+    if word := p.word(); !strings.EqualFold(word, "return") {
+        return nil, p.errorf("expected return, got %q", word)
+    }
+    value, err := p.value()
+    if err != nil {
+        return nil, err
+    }
+    array, ok := value.(phpArray)
+    if !ok {
+        return nil, p.errorf("file does not return an array")
+    }
+    return array, nil
+}
+
+// lookup walks nested arrays by key and returns nil when a level is missing
+func (a phpArray) lookup(keys ...string) interface{} {
+    var current interface{} = a
+    for _, key := range keys {
+        array, ok := current.(phpArray)
+        if !ok {
+            return nil
+        }
+        current = array[key]
+    }
+    return current
+}
+
+// phpString converts a scalar the way PHP's (string) cast does
+func phpString(v interface{}) string {
+    switch val := v.(type) {
+    case string:
+        return val
+    case int64:
+        return strconv.FormatInt(val, 10)
+    case float64:
+        return strconv.FormatFloat(val, 'G', 14, 64)
+    case bool:
+        if val {
+            return "1"
+        }
+    }
+    return ""
+}
+
+type phpParser struct {
+    src string
+    pos int
+}
+
+func (p *phpParser) errorf(format string, args ...interface{}) error {
+    line := strings.Count(p.src[:p.pos], "\n") + 1
+    return fmt.Errorf("php: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *phpParser) skipOpenTag() {
+    p.skipSpace()
+    if strings.HasPrefix(p.src[p.pos:], "<?php") {
+        p.pos += len("<?php")
+    }
+}
+
+// skipSpace skips whitespace and //, # and /* */ comments
+func (p *phpParser) skipSpace() {
+    for p.pos < len(p.src) {
+        rest := p.src[p.pos:]
+        switch {
+        case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r':
+            p.pos++
+        case strings.HasPrefix(rest, "//") || rest[0] == '#':
+            if end := strings.IndexByte(rest, '\n'); end >= 0 {
+                p.pos += end + 1
+            } else {
+                p.pos = len(p.src)
+            }
+        case strings.HasPrefix(rest, "/*"):
+            if end := strings.Index(rest[2:], "*/"); end >= 0 {
+                p.pos += end + 4
+            } else {
+                p.pos = len(p.src)
+            }
+        default:
+            return
+        }
+    }
+}
+
+// word reads an identifier
+func (p *phpParser) word() string {
+    p.skipSpace()
+    start := p.pos
+    for p.pos < len(p.src) {
+        c := p.src[p.pos]
+        if c == '_' || c == '\\' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+            p.pos++
+            continue
+        }
+        break
+    }
+    return p.src[start:p.pos]
+}
+
+// consume skips token if it comes next
+func (p *phpParser) consume(token string) bool {
+    p.skipSpace()
+    if strings.HasPrefix(p.src[p.pos:], token) {
+        p.pos += len(token)
+        return true
+    }
+    return false
+}
+
+func (p *phpParser) value() (interface{}, error) {
+    p.skipSpace()
+    if p.pos >= len(p.src) {
+        return nil, p.errorf("unexpected end of file")
+    }
+
+    switch c := p.src[p.pos]; {
+    case c == '[':
+        p.pos++
+        return p.array("]")
+    case c == '\'':
+        return p.singleQuoted()
+    case c == '"':
+        return p.doubleQuoted()
+    case c == '-' || c == '+' || c == '.' || '0' <= c && c <= '9':
+        return p.number()
+    }
+
+    word := p.word()
+    switch strings.ToLower(word) {
+    case "array":
+        if !p.consume("(") {
+            return nil, p.errorf("expected ( after array")
+        }
+        return p.array(")")
+    case "true":
+        return true, nil
+    case "false":
+        return false, nil
+    case "null":
+        return nil, nil
+    case "":
+        return nil, p.errorf("unexpected character %q", p.src[p.pos])
+    }
+    return nil, p.errorf("unsupported expression %q", word)
+}
+
+func (p *phpParser) array(closing string) (phpArray, error) {
+    array := phpArray{}
+    next := int64(0)
+    for {
+        if p.consume(closing) {
+            return array, nil
+        }
+
+        first, err := p.value()
+        if err != nil {
+            return nil, err
+        }
+        if p.consume("=>") {
+            value, err := p.value()
+            if err != nil {
+                return nil, err
+            }
+            key := phpString(first)
+            if n, err := strconv.ParseInt(key, 10, 64); err == nil && strconv.FormatInt(n, 10) == key {
+                if n >= next {
+                    next = n + 1
+                }
+            }
+            array[key] = value
+        } else {
+            array[strconv.FormatInt(next, 10)] = first
+            next++
+        }
+
+        if !p.consume(",") {
+            if p.consume(closing) {
+                return array, nil
+            }
+            return nil, p.errorf("expected , or %s", closing)
+        }
+    }
+}
+
+func (p *phpParser) singleQuoted() (string, error) {
+    var b strings.Builder
+    for p.pos++; p.pos < len(p.src); p.pos++ {
+        c := p.src[p.pos]
+        switch {
+        case c == '\'':
+            p.pos++
+            return b.String(), nil
+        case c == '\\' && p.pos+1 < len(p.src) && (p.src[p.pos+1] == '\'' || p.src[p.pos+1] == '\\'):
+            p.pos++
+            b.WriteByte(p.src[p.pos])
+        default:
+            b.WriteByte(c)
+        }
+    }
+    return "", p.errorf("unterminated string")
+}
+
+func (p *phpParser) doubleQuoted() (string, error) {
+    var b strings.Builder
+    for p.pos++; p.pos < len(p.src); p.pos++ {
+        c := p.src[p.pos]
+        if c == '"' {
+            p.pos++
+            return b.String(), nil
+        }
+        if c == '$' && p.pos+1 < len(p.src) && (p.src[p.pos+1] == '{' || p.src[p.pos+1] == '_' || isLetter(p.src[p.pos+1])) {
+            return "", p.errorf("variable interpolation is not supported")
+        }
+        if c != '\\' || p.pos+1 >= len(p.src) {
+            b.WriteByte(c)
+            continue
+        }
+
+        p.pos++
+        switch e := p.src[p.pos]; e {
+        case 'n':
+            b.WriteByte('\n')
+        case 't':
+            b.WriteByte('\t')
+        case 'r':
+            b.WriteByte('\r')
+        case 'v':
+            b.WriteByte('\v')
+        case 'e':
+            b.WriteByte(0x1b)
+        case 'f':
+            b.WriteByte('\f')
+        case '\\', '$', '"':
+            b.WriteByte(e)
+        case 'x':
+            end := p.pos + 1
+            for end < len(p.src) && end < p.pos+3 && isHex(p.src[end]) {
+                end++
+            }
+            if end == p.pos+1 {
+                b.WriteString(`\x`)
+                continue
+            }
+            v, _ := strconv.ParseUint(p.src[p.pos+1:end], 16, 8)
+            b.WriteByte(byte(v))
+            p.pos = end - 1
+        case 'u':
+            end := strings.IndexByte(p.src[p.pos:], '}')
+            if !strings.HasPrefix(p.src[p.pos:], "u{") || end < 0 {
+                b.WriteString(`\u`)
+                continue
+            }
+            v, err := strconv.ParseUint(p.src[p.pos+2:p.pos+end], 16, 32)
+            if err != nil {
+                return "", p.errorf("invalid unicode escape")
+            }
+            b.WriteString(string(rune(v)))
+            p.pos += end
+        default:
+            if '0' <= e && e <= '7' {
+                end := p.pos
+                for end < len(p.src) && end < p.pos+3 && '0' <= p.src[end] && p.src[end] <= '7' {
+                    end++
+                }
+                v, _ := strconv.ParseUint(p.src[p.pos:end], 8, 16)
+                b.WriteByte(byte(v))
+                p.pos = end - 1
+                continue
+            }
+            b.WriteByte('\\')
+            b.WriteByte(e)
+        }
+    }
+    return "", p.errorf("unterminated string")
+}
+
+func (p *phpParser) number() (interface{}, error) {
+    start := p.pos
+    if c := p.src[p.pos]; c == '-' || c == '+' {
+        p.pos++
+    }
+    for p.pos < len(p.src) {
+        c := p.src[p.pos]
+        if c == '.' || c == '_' || c == 'x' || c == 'X' || c == 'e' || c == 'E' || isHex(c) ||
+            (c == '-' || c == '+') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E') {
+            p.pos++
+            continue
+        }
+        break
+    }
+
+    literal := strings.ReplaceAll(p.src[start:p.pos], "_", "")
+    if n, err := strconv.ParseInt(literal, 0, 64); err == nil {
+        return n, nil
+    }
+    if f, err := strconv.ParseFloat(literal, 64); err == nil {
+        return f, nil
+    }
+    return nil, p.errorf("invalid number %q", literal)
+}
+
+func isLetter(c byte) bool {
+    return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= utf8.RuneSelf
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParsePHPReturnArray(t *testing.T) {
+    tests := []struct {
+        name string
+        src  string
+        want phpArray
+    }{
+        {
+            "short syntax with trailing commas",
+            `<?php return ['a' => ['x', 'y',], 'b' => 1,];`,
+            phpArray{"a": phpArray{"0": "x", "1": "y"}, "b": int64(1)},
+        },
+        {
+            "long syntax",
+            "<?php\nreturn array(\n  'a' => array(1, 2),\n  'B' => ARRAY(),\n);\n",
+            phpArray{"a": phpArray{"0": int64(1), "1": int64(2)}, "B": phpArray{}},
+        },
+        {
+            "comments",
+            "<?php\n// line\n# hash\n/* block\n   'x' => 1, */\nreturn [ # after\n  'a' => /* inline */ 'b', // tail\n];",
+            phpArray{"a": "b"},
+        },
+        {
+            "single quoted escapes",
+            `<?php return ['it\'s', 'C:\\path', 'keep\n', 'a\b'];`,
+            phpArray{"0": "it's", "1": `C:\path`, "2": `keep\n`, "3": `a\b`},
+        },
+        {
+            "double quoted escapes",
+            `<?php return ["say \"hi\"", "a\tb\n", "\x41\101\u{e9}", "\$5", "\q"];`,
+            phpArray{"0": `say "hi"`, "1": "a\tb\n", "2": "AAé", "3": "$5", "4": `\q`},
+        },
+        {
+            "numeric keys",
+            `<?php return [5 => 'a', 'b', '7' => 'c', 'd', '07' => 'e', -1 => 'f'];`,
+            phpArray{"5": "a", "6": "b", "7": "c", "8": "d", "07": "e", "-1": "f"},
+        },
+        {
+            "scalars",
+            `<?php return ['i' => -3, 'u' => 1_000, 'h' => 0x1F, 'f' => 1.5, 't' => TRUE, 'n' => null, 'x' => false];`,
+            phpArray{"i": int64(-3), "u": int64(1000), "h": int64(31), "f": 1.5, "t": true, "n": nil, "x": false},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parsePHPReturnArray(tt.src)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %#v\nwant %#v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestParsePHPReturnArrayRejectsDynamicValues(t *testing.T) {
+    tests := []struct {
+        name string
+        src  string
+        err  string
+    }{
+        {"getenv", `<?php return ['db' => ['password' => getenv('DB_PASSWORD')]];`, `unsupported expression "getenv"`},
+        {"constant", `<?php return ['eol' => PHP_EOL];`, `unsupported expression "PHP_EOL"`},
+        {"class constant", `<?php return ['mode' => \Magento\Framework\App\State::MODE_PRODUCTION];`, "unsupported expression"},
+        {"variable", `<?php return ['a' => $a];`, "unexpected character"},
+        {"interpolation", `<?php return ['a' => "x$a"];`, "interpolation"},
+        {"not a return", `<?php $env = [];`, "expected return"},
+        {"not an array", `<?php return 'x';`, "does not return an array"},
+        {"unterminated", "<?php return [\n'a' => 'b\n", "unterminated string"},
+        {"missing comma", `<?php return ['a' 'b'];`, "expected , or ]"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parsePHPReturnArray(tt.src)
+            if err == nil {
+                t.Fatalf("parsed %#v without error", got)
+            }
+            if !strings.Contains(err.Error(), tt.err) {
+                t.Errorf("error %q, want it to mention %q", err, tt.err)
+            }
+        })
+    }
+}
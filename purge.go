@@ -0,0 +1,220 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "regexp"
+    "strings"
+
+    "github.com/go-redis/redis/v8"
+)
+
+const (
+    // Header Magento\CacheInvalidate\Model\PurgeCache sends with every PURGE request
+    tagsPatternHeader = "X-Magento-Tags-Pattern"
+
+    // Set to "skipped" on a PURGE answered while the breaker keeps Redis out
+    purgeRedisHeader = "Fast-Cache-Purge-Redis"
+)
+
+// errRedisSkipped means the Redis tier was not asked at all
+var errRedisSkipped = errors.New("redis skipped")
+
+// handleVarnishPurge answers PURGE requests the way Magento's varnish6.vcl does:
+// the pattern is a regex matched against each page's comma separated tag list
+func handleVarnishPurge(w http.ResponseWriter, r *http.Request) {
+    config := loadConfig()
+
+    if !purgeAllowed(r, config) {
+        warnLog("PURGE from %s rejected\n", r.RemoteAddr)
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    pattern := r.Header.Get(tagsPatternHeader)
+    if pattern == "" {
+        http.Error(w, "X-Magento-Tags-Pattern header required", http.StatusBadRequest)
+        return
+    }
+    re, err := regexp.Compile(pattern)
+    if err != nil {
+        errorLog("Invalid PURGE pattern %q: %v\n", pattern, err)
+        http.Error(w, "Invalid X-Magento-Tags-Pattern", http.StatusBadRequest)
+        return
+    }
+
+    local := purgeLocalPattern(re)
+    var removed int
+    if rdb != nil {
+        removed, err = purgeRedisPattern(re)
+        if err == errRedisSkipped {
+            // Pages written while Redis is out are local only and already gone
+            warnLog("PURGE %s: Redis is %s, purged %d local pages only\n", pattern, redisState.State(), local)
+            w.Header().Set(purgeRedisHeader, "skipped")
+        } else if err != nil {
+            errorLog("Redis PURGE failed: %v\n", err)
+            http.Error(w, "Redis purge failed", http.StatusServiceUnavailable)
+            return
+        }
+    }
+
+    if config.Debug {
+        debugLog("🧹 PURGE %s: %d local, %d Redis pages\n", pattern, local, removed)
+    }
+    fmt.Fprint(w, "Purged")
+}
+
+// purgeAllowed checks the client address against PURGE_ALLOW (the VCL "purge" acl)
+func purgeAllowed(r *http.Request, config *CacheConfig) bool {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return false
+    }
+    for _, network := range config.PurgeAllow {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// parseNetworks reads a comma separated list of IPs and CIDRs
+func parseNetworks(list string) []*net.IPNet {
+    var networks []*net.IPNet
+    for _, item := range strings.Split(list, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            continue
+        }
+        if !strings.Contains(item, "/") {
+            if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+                item += "/32"
+            } else {
+                item += "/128"
+            }
+        }
+        if _, network, err := net.ParseCIDR(item); err == nil {
+            networks = append(networks, network)
+        } else {
+            warnLog("Ignoring invalid network %q: %v\n", item, err)
+        }
+    }
+    return networks
+}
+
+// purgeLocalPattern evicts local pages whose tag list matches re. A pattern
+// matching the empty string (".*" from a full flush) also hits untagged pages.
+func purgeLocalPattern(re *regexp.Regexp) int {
+    if localCache == nil {
+        return 0
+    }
+
+    var keys []string
+    if re.MatchString("") {
+        for key := range localCache.Items() {
+            keys = append(keys, key)
+        }
+    } else {
+        keys = localTags.keysMatching(re)
+    }
+    for _, key := range keys {
+        evictLocal(key)
+    }
+    match := func(tags []string) bool { return re.MatchString(strings.Join(tags, ",")) }
+    purgeGrace(match, keys...)
+    diskCache.purge(match)
+    return len(keys)
+}
+
+// keysMatching returns keys whose joined tag list matches re
+func (ti *tagIndex) keysMatching(re *regexp.Regexp) []string {
+    ti.mu.RLock()
+    defer ti.mu.RUnlock()
+
+    var keys []string
+    for key, tags := range ti.tags {
+        if re.MatchString(strings.Join(tags, ",")) {
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
+
+// purgeRedisPattern cleans every Cm_Cache tag whose name matches re, like
+// Cm_Cache_Backend_Redis::clean(Zend_Cache::CLEANING_MODE_MATCHING_ANY_TAG)
+func purgeRedisPattern(re *regexp.Regexp) (int, error) {
+    if !redisState.allow() {
+        return 0, errRedisSkipped
+    }
+    config := loadConfig()
+    purgeCtx, cancel := redisPurgeContext()
+    defer cancel()
+
+    allTags, err := rdb.SMembers(purgeCtx, cmTagsSet).Result()
+    if err != nil {
+        redisState.failure(err)
+        return 0, err
+    }
+    var tagIds []string
+    for _, tagId := range allTags {
+        if !strings.HasPrefix(tagId, config.Prefix) {
+            continue
+        }
+        if re.MatchString(strings.ToLower(strings.TrimPrefix(tagId, config.Prefix))) {
+            tagIds = append(tagIds, tagId)
+        }
+    }
+    removed, err := cleanRedisTags(purgeCtx, tagIds)
+    redisState.failure(err)
+    return removed, err
+}
+
+// cleanRedisTags deletes all records of the given tag ids together with the tag sets
+func cleanRedisTags(ctx context.Context, tagIds []string) (int, error) {
+    if len(tagIds) == 0 {
+        return 0, nil
+    }
+
+    members := make([]*redis.StringSliceCmd, len(tagIds))
+    _, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+        for i, tagId := range tagIds {
+            members[i] = pipe.SMembers(ctx, cmTagIdsPrefix+tagId)
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    seen := make(map[string]bool)
+    var keys []string
+    for _, cmd := range members {
+        for _, id := range cmd.Val() {
+            if !seen[id] {
+                seen[id] = true
+                keys = append(keys, corePrefix+id)
+            }
+        }
+    }
+
+    tagKeys := make([]interface{}, len(tagIds))
+    _, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+        for _, key := range keys {
+            pipe.Del(ctx, key)
+        }
+        for i, tagId := range tagIds {
+            pipe.Del(ctx, cmTagIdsPrefix+tagId)
+            tagKeys[i] = tagId
+        }
+        pipe.SRem(ctx, cmTagsSet, tagKeys...)
+        return nil
+    })
+    return len(keys), err
+}
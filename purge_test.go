@@ -0,0 +1,113 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// usePurge allows PURGE from 127.0.0.1 and 10.0.0.0/8 and keeps Redis out
+func usePurge(t *testing.T) {
+    t.Helper()
+    useDisk(t)
+    config := loadConfig()
+    saved, savedState := *config, redisState
+    config.PurgeAllow = parseNetworks("127.0.0.1, 10.0.0.0/8, ::1, not-an-ip")
+    redisState = &redisHealth{state: redisProxyOnly}
+    t.Cleanup(func() {
+        *config = saved
+        redisState = savedState
+    })
+}
+
+func purge(remoteAddr, pattern string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("PURGE", "http://shop.example/", nil)
+    req.RemoteAddr = remoteAddr
+    if pattern != "" {
+        req.Header.Set(tagsPatternHeader, pattern)
+    }
+    rec := httptest.NewRecorder()
+    handleVarnishPurge(rec, req)
+    return rec
+}
+
+func TestPurgeAllowChecksClientNetwork(t *testing.T) {
+    usePurge(t)
+    tests := []struct {
+        remoteAddr string
+        allowed    bool
+    }{
+        {"127.0.0.1:51000", true},
+        {"10.20.30.40:80", true},
+        {"[::1]:51000", true},
+        {"127.0.0.2:51000", false},
+        {"192.168.1.10:80", false},
+        {"[::2]:80", false},
+        {"not-an-ip", false},
+    }
+    for _, tt := range tests {
+        rec := purge(tt.remoteAddr, "cat_p_1")
+        if allowed := rec.Code != http.StatusMethodNotAllowed; allowed != tt.allowed {
+            t.Errorf("PURGE from %s: status %d, allowed %v, want %v", tt.remoteAddr, rec.Code, allowed, tt.allowed)
+        }
+    }
+    if got := len(loadConfig().PurgeAllow); got != 3 {
+        t.Errorf("%d networks parsed, want 3 without the invalid entry", got)
+    }
+}
+
+func TestPurgePatternMatchesTagLists(t *testing.T) {
+    pages := map[string][]string{
+        "PRODUCT":  {"cat_p_1", "cat_c_3"},
+        "OTHER":    {"cat_p_11"},
+        "BLOCK":    {"cms_b_footer"},
+        "UNTAGGED": nil,
+    }
+    tests := []struct {
+        name    string
+        pattern string
+        purged  []string
+    }{
+        // Magento\CacheInvalidate\Model\PurgeCache joins tags like this
+        {"tags", "((^|,)cat_p_1(,|$))|((^|,)cms_b_footer(,|$))", []string{"PRODUCT", "BLOCK"}},
+        {"full flush", ".*", []string{"PRODUCT", "OTHER", "BLOCK", "UNTAGGED"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            usePurge(t)
+            for key, tags := range pages {
+                localCache.Set(key, CacheEntry{Content: key, Tags: tags}, time.Hour)
+                localTags.set(key, tags)
+                t.Cleanup(func() { localTags.remove(key) })
+            }
+
+            rec := purge("127.0.0.1:51000", tt.pattern)
+            if rec.Code != http.StatusOK {
+                t.Fatalf("status %d, want 200", rec.Code)
+            }
+            if rdb != nil && rec.Header().Get(purgeRedisHeader) != "skipped" {
+                t.Errorf("%s %q, want skipped while Redis is proxy-only", purgeRedisHeader, rec.Header().Get(purgeRedisHeader))
+            }
+
+            purged := map[string]bool{}
+            for _, key := range tt.purged {
+                purged[key] = true
+            }
+            for key := range pages {
+                if got := !localCache.Contains(key); got != purged[key] {
+                    t.Errorf("%s purged %v, want %v", key, got, purged[key])
+                }
+            }
+        })
+    }
+}
+
+func TestPurgeRejectsBadPatterns(t *testing.T) {
+    usePurge(t)
+    for _, pattern := range []string{"", "((^|,)cat_p_1"} {
+        if rec := purge("127.0.0.1:51000", pattern); rec.Code != http.StatusBadRequest {
+            t.Errorf("PURGE with pattern %q: status %d, want 400", pattern, rec.Code)
+        }
+    }
+}
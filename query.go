@@ -0,0 +1,163 @@
+package main
+
+import (
+    "hash/fnv"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// defaultStripParams are the click and campaign ids Magento's Varnish VCL
+// removes before hashing, plus the Google Analytics linker ones
+const defaultStripParams = "gclid,gclsrc,gbraid,wbraid,gad_source,dclid,msclkid,fbclid,srsltid,_ga,_gl,cx,ie,cof,siteurl,zanpid,origin,mc_*,utm_*,_bta_*"
+
+// queryVariantLimit caps the URLs remembered per set by queryStats
+const queryVariantLimit = 100000
+
+var queryStats = newQueryNormalizerStats()
+
+// parseStripParams reads QUERY_STRIP_PARAMS: exact names, or prefixes ending in "*"
+func parseStripParams(spec string) []string {
+    var params []string
+    for _, name := range strings.Split(spec, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            params = append(params, name)
+        }
+    }
+    return params
+}
+
+// queryNormalizeWarning explains why QUERY_NORMALIZE and a shared Redis tier
+// do not mix; it is empty when they are not combined
+func queryNormalizeWarning(config *CacheConfig, redisReads bool) string {
+    if !config.QueryNormalize {
+        return ""
+    }
+    switch {
+    case config.WriteThrough:
+        return "Warning: QUERY_NORMALIZE with REDIS_WRITE_THROUGH saves pages under keys Magento never builds, rewritten URLs are cached twice in Redis\n"
+    case redisReads:
+        return "Warning: QUERY_NORMALIZE keys do not match Magento's, pages Magento saved in Redis for rewritten URLs are not found\n"
+    }
+    return ""
+}
+
+// checkQueryNormalize logs queryNormalizeWarning at startup
+func checkQueryNormalize(config *CacheConfig, redisReads bool) {
+    if warning := queryNormalizeWarning(config, redisReads); warning != "" {
+        warnLog("%s", warning)
+    }
+}
+
+// stripParam reports whether the query parameter name is listed in QUERY_STRIP_PARAMS
+func stripParam(name string, params []string) bool {
+    for _, p := range params {
+        if prefix, ok := strings.CutSuffix(p, "*"); ok {
+            if strings.HasPrefix(name, prefix) {
+                return true
+            }
+        } else if name == p {
+            return true
+        }
+    }
+    return false
+}
+
+// normalizeQuery drops the listed parameters from a raw query string, then
+// sorts what is left by name (keeping the order of repeated names) and removes
+// exact duplicates, so every ordering of the same parameters shares one key
+func normalizeQuery(rawQuery string, config *CacheConfig) string {
+    if rawQuery == "" {
+        return ""
+    }
+    type param struct {
+        name string
+        raw  string
+    }
+    var params []param
+    seen := make(map[string]bool)
+    for _, pair := range strings.Split(rawQuery, "&") {
+        if pair == "" || seen[pair] {
+            continue
+        }
+        seen[pair] = true
+        key, _, _ := strings.Cut(pair, "=")
+        name := phpURLDecode(key)
+        if stripParam(name, config.QueryStripParams) {
+            continue
+        }
+        params = append(params, param{name: name, raw: pair})
+    }
+    sort.SliceStable(params, func(i, j int) bool { return params[i].name < params[j].name })
+
+    pairs := make([]string, len(params))
+    for i, p := range params {
+        pairs[i] = p.raw
+    }
+    return strings.Join(pairs, "&")
+}
+
+// queryNormalizerStats counts the URLs the normalizer folded together. Distinct
+// URLs are tracked as 64 bit hashes up to queryVariantLimit each.
+type queryNormalizerStats struct {
+    mu         sync.Mutex
+    requests   int64
+    rewritten  int64
+    raw        map[uint64]struct{}
+    normalized map[uint64]struct{}
+    truncated  bool
+}
+
+// queryNormalizerSnapshot is the JSON form of queryNormalizerStats
+type queryNormalizerSnapshot struct {
+    Requests      int64 `json:"requests"`
+    Rewritten     int64 `json:"rewritten"`
+    DistinctURLs  int   `json:"distinct_urls"`
+    DistinctKeys  int   `json:"distinct_keys"`
+    VariantsSaved int   `json:"variants_saved"`
+    Truncated     bool  `json:"truncated,omitempty"`
+}
+
+func newQueryNormalizerStats() *queryNormalizerStats {
+    return &queryNormalizerStats{
+        raw:        make(map[uint64]struct{}),
+        normalized: make(map[uint64]struct{}),
+    }
+}
+
+// observe records one cacheable request URL before and after normalization
+func (s *queryNormalizerStats) observe(rawURL, normalizedURL string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.requests++
+    if rawURL != normalizedURL {
+        s.rewritten++
+    }
+    if len(s.raw) >= queryVariantLimit || len(s.normalized) >= queryVariantLimit {
+        s.truncated = true
+        return
+    }
+    s.raw[hashURL(rawURL)] = struct{}{}
+    s.normalized[hashURL(normalizedURL)] = struct{}{}
+}
+
+func (s *queryNormalizerStats) snapshot() queryNormalizerSnapshot {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return queryNormalizerSnapshot{
+        Requests:      s.requests,
+        Rewritten:     s.rewritten,
+        DistinctURLs:  len(s.raw),
+        DistinctKeys:  len(s.normalized),
+        VariantsSaved: len(s.raw) - len(s.normalized),
+        Truncated:     s.truncated,
+    }
+}
+
+func hashURL(url string) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(url))
+    return h.Sum64()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseStripParams(t *testing.T) {
+    tests := []struct {
+        spec string
+        want []string
+    }{
+        {"", nil},
+        {" , ,", nil},
+        {"gclid", []string{"gclid"}},
+        {" gclid , utm_* ,,fbclid ", []string{"gclid", "utm_*", "fbclid"}},
+    }
+    for _, tt := range tests {
+        if got := parseStripParams(tt.spec); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseStripParams(%q) = %q, want %q", tt.spec, got, tt.want)
+        }
+    }
+
+    params := parseStripParams(defaultStripParams)
+    for _, name := range []string{"gclid", "fbclid", "utm_source", "utm_", "mc_cid", "_bta_tid"} {
+        if !stripParam(name, params) {
+            t.Errorf("default QUERY_STRIP_PARAMS keep %s", name)
+        }
+    }
+    for _, name := range []string{"p", "q", "utm", "gclid2", "xgclid", "product_list_order"} {
+        if stripParam(name, params) {
+            t.Errorf("default QUERY_STRIP_PARAMS strip %s", name)
+        }
+    }
+}
+
+func TestNormalizeQuery(t *testing.T) {
+    config := &CacheConfig{QueryStripParams: parseStripParams("gclid,utm_*")}
+    tests := []struct {
+        name  string
+        query string
+        want  string
+    }{
+        {"empty", "", ""},
+        {"sorted by name", "q=shoe&p=2&color=red", "color=red&p=2&q=shoe"},
+        {"repeated names keep their order", "size=l&color=red&size=m&size=s", "color=red&size=l&size=m&size=s"},
+        {"exact duplicates dropped", "p=2&q=a&p=2&p=3", "p=2&p=3&q=a"},
+        {"same value other spelling kept", "q=a+b&q=a%20b", "q=a+b&q=a%20b"},
+        {"empty pairs dropped", "&&q=a&&", "q=a"},
+        {"names without value", "b&a=&a", "a=&a&b"},
+        {"stripped", "gclid=x&p=2&utm_source=mail&utm_medium=y", "p=2"},
+        {"encoded names are stripped", "utm%5Fsource=mail&p=2", "p=2"},
+        {"everything stripped", "gclid=x&utm_campaign=y", ""},
+        {"values are not decoded", "q=%C3%BC&p=1", "p=1&q=%C3%BC"},
+    }
+    for _, tt := range tests {
+        if got := normalizeQuery(tt.query, config); got != tt.want {
+            t.Errorf("%s: normalizeQuery(%q) = %q, want %q", tt.name, tt.query, got, tt.want)
+        }
+    }
+}
+
+func TestQueryNormalizeWarning(t *testing.T) {
+    tests := []struct {
+        name         string
+        normalize    bool
+        writeThrough bool
+        redisReads   bool
+        want         string
+    }{
+        {"off", false, true, true, ""},
+        {"local only", true, false, false, ""},
+        {"write-through", true, true, true, "REDIS_WRITE_THROUGH"},
+        {"redis reads", true, false, true, "not found"},
+    }
+    for _, tt := range tests {
+        config := &CacheConfig{QueryNormalize: tt.normalize, WriteThrough: tt.writeThrough}
+        got := queryNormalizeWarning(config, tt.redisReads)
+        if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+            t.Errorf("%s: warning %q, want one mentioning %q", tt.name, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// Supported Redis topologies (REDIS_MODE)
+const (
+    redisModeStandalone = "standalone"
+    redisModeSentinel   = "sentinel"
+    redisModeCluster    = "cluster"
+)
+
+// newRedisClient builds a client for the configured topology. All three kinds
+// implement redis.UniversalClient, so the rest of the server does not care.
+func newRedisClient(config *CacheConfig) (redis.UniversalClient, error) {
+    tlsConfig, err := redisTLSConfig(config)
+    if err != nil {
+        return nil, err
+    }
+
+    options := &redis.UniversalOptions{
+        Addrs:            redisAddrs(config),
+        DB:               config.RedisDB,
+        Username:         config.RedisUsername,
+        Password:         config.RedisPassword,
+        SentinelUsername: config.SentinelUsername,
+        SentinelPassword: config.SentinelPassword,
+        MasterName:       config.SentinelMaster,
+        TLSConfig:        tlsConfig,
+    }
+
+    // Magento installs often talk to Redis over a unix socket
+    if strings.HasPrefix(config.RedisHost, "/") && config.RedisAddrs == "" {
+        socket := config.RedisHost
+        options.Dialer = func(ctx context.Context, _, _ string) (net.Conn, error) {
+            var dialer net.Dialer
+            return dialer.DialContext(ctx, "unix", socket)
+        }
+    }
+
+    switch config.RedisMode {
+    case redisModeSentinel:
+        if options.MasterName == "" {
+            return nil, fmt.Errorf("REDIS_SENTINEL_MASTER is required in sentinel mode")
+        }
+        return redis.NewFailoverClient(options.Failover()), nil
+    case redisModeCluster:
+        if config.RedisDB != 0 {
+            warnLog("Redis Cluster only has DB 0, ignoring REDIS_DB=%d\n", config.RedisDB)
+        }
+        return redis.NewClusterClient(options.Cluster()), nil
+    case redisModeStandalone:
+        return redis.NewClient(options.Simple()), nil
+    default:
+        return nil, fmt.Errorf("unknown REDIS_MODE %q", config.RedisMode)
+    }
+}
+
+// redisAddrs returns the seed addresses: REDIS_ADDRS for sentinels and cluster
+// nodes, otherwise REDIS_HOST:REDIS_PORT
+func redisAddrs(config *CacheConfig) []string {
+    var addrs []string
+    for _, addr := range strings.Split(config.RedisAddrs, ",") {
+        if addr = strings.TrimSpace(addr); addr != "" {
+            addrs = append(addrs, addr)
+        }
+    }
+    if len(addrs) == 0 && strings.HasPrefix(config.RedisHost, "/") {
+        addrs = []string{config.RedisHost}
+    } else if len(addrs) == 0 {
+        addrs = []string{net.JoinHostPort(config.RedisHost, config.RedisPort)}
+    }
+    return addrs
+}
+
+// redisDB is the database keyspace notifications are published for
+func redisDB(config *CacheConfig) int {
+    if config.RedisMode == redisModeCluster {
+        return 0
+    }
+    return config.RedisDB
+}
+
+// describeRedis summarizes the connection for the startup banner
+func describeRedis(config *CacheConfig) string {
+    addrs := strings.Join(redisAddrs(config), ",")
+    desc := fmt.Sprintf("%s %s (DB: %d)", config.RedisMode, addrs, redisDB(config))
+    if config.RedisMode == redisModeSentinel {
+        desc += " master " + config.SentinelMaster
+    }
+    if config.RedisUsername != "" {
+        desc += " user " + config.RedisUsername
+    }
+    if config.RedisTLS {
+        desc += " TLS"
+    }
+    return desc
+}
+
+// redisTLSConfig builds the TLS settings from REDIS_TLS_* variables
+func redisTLSConfig(config *CacheConfig) (*tls.Config, error) {
+    if !config.RedisTLS {
+        return nil, nil
+    }
+
+    tlsConfig := &tls.Config{
+        MinVersion:         tls.VersionTLS12,
+        ServerName:         config.RedisTLSServerName,
+        InsecureSkipVerify: config.RedisTLSInsecure,
+    }
+
+    if config.RedisTLSCA != "" {
+        pem, err := os.ReadFile(config.RedisTLSCA)
+        if err != nil {
+            return nil, fmt.Errorf("reading REDIS_TLS_CA: %w", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in %s", config.RedisTLSCA)
+        }
+        tlsConfig.RootCAs = pool
+    }
+
+    if config.RedisTLSCert != "" || config.RedisTLSKey != "" {
+        cert, err := tls.LoadX509KeyPair(config.RedisTLSCert, config.RedisTLSKey)
+        if err != nil {
+            return nil, fmt.Errorf("loading Redis client certificate: %w", err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    return tlsConfig, nil
+}
+
+// redisMasters returns one client per node that publishes keyspace events:
+// every master of a cluster, or the client itself otherwise
+func redisMasters() []redis.UniversalClient {
+    cluster, ok := rdb.(*redis.ClusterClient)
+    if !ok {
+        return []redis.UniversalClient{rdb}
+    }
+
+    var mu sync.Mutex
+    var masters []redis.UniversalClient
+    err := cluster.ForEachMaster(ctx, func(_ context.Context, master *redis.Client) error {
+        mu.Lock()
+        masters = append(masters, master)
+        mu.Unlock()
+        return nil
+    })
+    if err != nil {
+        warnLog("Cannot list Redis Cluster masters: %v\n", err)
+    }
+    return masters
+}
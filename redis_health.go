@@ -0,0 +1,196 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// Redis tier states, exposed in logs, the Fast-Cache-Redis header and /cache/stats
+const (
+    redisHealthy   = "healthy"    // Redis is used for every cacheable request
+    redisDegraded  = "degraded"   // Circuit breaker open, Redis is skipped until a trial call succeeds
+    redisProxyOnly = "proxy-only" // Redis unreachable, serving from local cache and backend only
+)
+
+var redisState = &redisHealth{state: redisProxyOnly}
+
+// redisHealth is the Redis tier state machine. The background monitor moves
+// between proxy-only and healthy, request failures trip the circuit breaker
+// into degraded and a successful half-open trial closes it again.
+type redisHealth struct {
+    mu         sync.Mutex
+    state      string
+    failures   int       // Consecutive request failures
+    openUntil  time.Time // End of the breaker cooldown while degraded
+    trial      bool      // Half-open trial request in flight
+    lastError  string
+    changedAt  time.Time
+    reconnects int
+    trips      int
+}
+
+// redisHealthSnapshot is the JSON form of redisHealth
+type redisHealthSnapshot struct {
+    State      string `json:"state"`
+    Since      string `json:"since"`
+    Failures   int    `json:"consecutive_failures"`
+    OpenUntil  string `json:"breaker_open_until,omitempty"`
+    LastError  string `json:"last_error,omitempty"`
+    Reconnects int    `json:"reconnects"`
+    Trips      int    `json:"breaker_trips"`
+}
+
+// State returns the current state name
+func (h *redisHealth) State() string {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.state
+}
+
+// allow reports whether a request may use Redis right now
+func (h *redisHealth) allow() bool {
+    if rdb == nil {
+        return false
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    switch h.state {
+    case redisHealthy:
+        return true
+    case redisDegraded:
+        // Half-open: let exactly one request probe Redis after the cooldown
+        if time.Now().After(h.openUntil) && !h.trial {
+            h.trial = true
+            return true
+        }
+    }
+    return false
+}
+
+// success records a working Redis call and closes the breaker
+func (h *redisHealth) success() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.failures = 0
+    h.trial = false
+    if h.state == redisDegraded {
+        h.setLocked(redisHealthy)
+        infoLog("Redis circuit breaker closed, Redis tier is healthy again\n")
+    }
+}
+
+// failure records a failed Redis call; redis.Nil is a miss, not a failure
+func (h *redisHealth) failure(err error) {
+    if err == nil || err == redis.Nil {
+        h.success()
+        return
+    }
+
+    config := loadConfig()
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.failures++
+    h.lastError = err.Error()
+
+    switch {
+    case h.state == redisDegraded:
+        // Failed half-open trial, wait another cooldown
+        h.trial = false
+        h.openUntil = time.Now().Add(config.RedisBreakerCooldown)
+    case h.state == redisHealthy && h.failures >= config.RedisBreakerFailures:
+        h.trips++
+        h.openUntil = time.Now().Add(config.RedisBreakerCooldown)
+        h.setLocked(redisDegraded)
+        warnLog("Redis circuit breaker open after %d failures (%v), skipping Redis for %s\n",
+            h.failures, err, config.RedisBreakerCooldown)
+    }
+}
+
+// release ends a call that returned before reaching Redis without an
+// outcome, so a half-open trial it held goes to the next request
+func (h *redisHealth) release() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.trial = false
+}
+
+// setConnected is called by the monitor with the result of its ping
+func (h *redisHealth) setConnected(err error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    if err != nil {
+        h.lastError = err.Error()
+        if h.state != redisProxyOnly {
+            h.setLocked(redisProxyOnly)
+            warnLog("Redis unreachable (%v). Working in proxy mode with local cache only.\n", err)
+        }
+        return
+    }
+
+    if h.state == redisProxyOnly {
+        if !h.changedAt.IsZero() {
+            h.reconnects++
+        }
+        h.failures = 0
+        h.trial = false
+        h.setLocked(redisHealthy)
+        infoLog("Redis connected, Redis tier is healthy\n")
+    }
+}
+
+func (h *redisHealth) setLocked(state string) {
+    h.state = state
+    h.changedAt = time.Now()
+}
+
+func (h *redisHealth) snapshot() redisHealthSnapshot {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    snap := redisHealthSnapshot{
+        State:      h.state,
+        Failures:   h.failures,
+        LastError:  h.lastError,
+        Reconnects: h.reconnects,
+        Trips:      h.trips,
+    }
+    if !h.changedAt.IsZero() {
+        snap.Since = h.changedAt.Format(time.RFC3339)
+    }
+    if h.state == redisDegraded {
+        snap.OpenUntil = h.openUntil.Format(time.RFC3339)
+    }
+    return snap
+}
+
+// redisContext bounds a request-path Redis call by REDIS_TIMEOUT
+func redisContext() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), loadConfig().RedisTimeout)
+}
+
+// redisPurgeContext bounds a purge, which walks tag sets and deletes many
+// records, by REDIS_PURGE_TIMEOUT
+func redisPurgeContext() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), loadConfig().RedisPurgeTimeout)
+}
+
+// monitorRedis pings Redis in the background so a Redis restart is picked up
+// without restarting the server. The keyspace watcher starts on first contact.
+func monitorRedis(config *CacheConfig) {
+    var watchOnce sync.Once
+    for {
+        pingCtx, cancel := context.WithTimeout(context.Background(), config.RedisHealthInterval)
+        err := rdb.Ping(pingCtx).Err()
+        cancel()
+        redisState.setConnected(err)
+
+        if err == nil && localCache != nil && config.KeyspaceEvents {
+            watchOnce.Do(func() { go watchKeyspace(config) })
+        }
+        time.Sleep(config.RedisHealthInterval)
+    }
+}
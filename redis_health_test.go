@@ -0,0 +1,114 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+// useRedisState installs a healthy breaker that trips after 2 failures and
+// cools down for cooldown
+func useRedisState(t *testing.T, cooldown time.Duration) *redisHealth {
+    t.Helper()
+    if rdb == nil {
+        t.Skip("no Redis client configured")
+    }
+    config := loadConfig()
+    saved, savedState := *config, redisState
+    config.RedisBreakerFailures = 2
+    config.RedisBreakerCooldown = cooldown
+    redisState = &redisHealth{state: redisHealthy}
+    t.Cleanup(func() {
+        *config = saved
+        redisState = savedState
+    })
+    return redisState
+}
+
+func TestRedisBreakerCycle(t *testing.T) {
+    h := useRedisState(t, 20*time.Millisecond)
+    errTimeout := errors.New("i/o timeout")
+
+    h.failure(errTimeout)
+    if h.State() != redisHealthy || !h.allow() {
+        t.Fatalf("tripped after one failure: %s", h.State())
+    }
+    h.failure(errTimeout)
+    if h.State() != redisDegraded {
+        t.Fatalf("state %s after 2 failures, want degraded", h.State())
+    }
+    if h.allow() {
+        t.Fatal("Redis allowed during the cooldown")
+    }
+
+    // Half-open: one trial, which fails and restarts the cooldown
+    time.Sleep(25 * time.Millisecond)
+    if !h.allow() {
+        t.Fatal("no trial after the cooldown")
+    }
+    if h.allow() {
+        t.Fatal("second request let through while the trial runs")
+    }
+    h.failure(errTimeout)
+    if h.State() != redisDegraded || h.allow() {
+        t.Fatalf("failed trial: state %s, want degraded with a new cooldown", h.State())
+    }
+
+    // A successful trial closes the breaker
+    time.Sleep(25 * time.Millisecond)
+    if !h.allow() {
+        t.Fatal("no trial after the second cooldown")
+    }
+    h.failure(nil)
+    if h.State() != redisHealthy || !h.allow() || !h.allow() {
+        t.Fatalf("state %s after a successful trial, want healthy", h.State())
+    }
+    if snap := h.snapshot(); snap.Trips != 1 || snap.Failures != 0 {
+        t.Errorf("snapshot %+v, want 1 trip and no failures", snap)
+    }
+}
+
+// A write-through that returns before reaching Redis hands the trial on
+func TestRedisTrialEndsOnEarlyReturn(t *testing.T) {
+    h := useRedisState(t, time.Millisecond)
+    h.failure(errors.New("down"))
+    h.failure(errors.New("down"))
+    time.Sleep(2 * time.Millisecond)
+
+    if !h.allow() {
+        t.Fatal("no trial after the cooldown")
+    }
+    expired := CacheEntry{Content: "page", Created: time.Now().Add(-time.Hour)}
+    if err := saveRedisEntry(context.Background(), "EXPIRED", expired, nil, time.Minute); err != nil {
+        t.Fatal(err)
+    }
+    if h.State() != redisDegraded {
+        t.Errorf("state %s, a call that never reached Redis decided the trial", h.State())
+    }
+    if !h.allow() {
+        t.Error("trial still taken after saveRedisEntry returned, Redis would stay skipped")
+    }
+}
+
+// A write-through that fails on Redis reports the failure
+func TestRedisTrialFailsOnUnreachableRedis(t *testing.T) {
+    h := useRedisState(t, time.Hour)
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    if ping := rdb.Ping(ctx).Err(); ping == nil {
+        t.Skip("Redis is reachable")
+    }
+
+    for i := 0; i < 2; i++ {
+        ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+        err := saveRedisEntry(ctx, "PAGE", CacheEntry{Content: "page", Created: time.Now()}, nil, time.Minute)
+        cancel()
+        if err == nil {
+            t.Fatal("write to unreachable Redis succeeded")
+        }
+    }
+    if h.State() != redisDegraded {
+        t.Errorf("state %s after 2 failed writes, want degraded", h.State())
+    }
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "sync"
+    "sync/atomic"
+)
+
+// refreshHeader marks a request that must skip the cache and revalidate the
+// page, like FPC.js sends it for its own background refreshes
+const refreshHeader = "Refresh"
+
+// revalidation is started by main; until then stale pages are not refreshed
+var revalidation *revalidator
+
+// refreshJob is one stale page waiting for a worker
+type refreshJob struct {
+    key string
+    req *http.Request
+}
+
+// revalidator refreshes stale pages with a fixed number of workers fed by a
+// bounded queue, keeping at most one refresh per key queued or running
+type revalidator struct {
+    queue   chan refreshJob
+    workers int
+
+    mu      sync.Mutex
+    pending map[string]struct{}
+
+    refreshed   int64 // Refreshes that stored a new page
+    uncacheable int64 // Refreshes the origin answered with a response that may not be stored
+    failed      int64 // Refreshes that got no response
+    coalesced   int64 // Refreshes dropped because a miss was already fetching the key
+    skipped     int64 // Stale hits whose key was already queued or running
+    dropped     int64 // Stale hits dropped because the queue was full
+    bypassed    int64 // Requests with the Refresh header that skipped the cache
+}
+
+// revalidatorSnapshot is the JSON form of revalidator
+type revalidatorSnapshot struct {
+    Workers     int   `json:"workers"`
+    QueueDepth  int   `json:"queue_depth"`
+    QueueSize   int   `json:"queue_size"`
+    Pending     int   `json:"pending"`
+    Refreshed   int64 `json:"refreshed"`
+    Uncacheable int64 `json:"uncacheable"`
+    Failed      int64 `json:"failed"`
+    Coalesced   int64 `json:"coalesced"`
+    Skipped     int64 `json:"skipped"`
+    Dropped     int64 `json:"dropped"`
+    Bypassed    int64 `json:"bypassed"`
+}
+
+// startRevalidator launches REFRESH_WORKERS workers behind a REFRESH_QUEUE sized queue
+func startRevalidator(config *CacheConfig) *revalidator {
+    workers := config.RefreshWorkers
+    if workers < 1 {
+        workers = 1
+    }
+    size := config.RefreshQueue
+    if size < 0 {
+        size = 0
+    }
+    rv := &revalidator{
+        queue:   make(chan refreshJob, size),
+        workers: workers,
+        pending: make(map[string]struct{}),
+    }
+    for i := 0; i < workers; i++ {
+        go rv.work(config)
+    }
+    return rv
+}
+
+// schedule queues a refresh of the stale page under key. The request is
+// cloned, since the client's request and response are gone by the time a
+// worker picks the job up.
+func (rv *revalidator) schedule(r *http.Request, key string) {
+    if rv == nil {
+        return
+    }
+
+    rv.mu.Lock()
+    defer rv.mu.Unlock()
+    if _, ok := rv.pending[key]; ok {
+        atomic.AddInt64(&rv.skipped, 1)
+        return
+    }
+
+    req := r.Clone(context.Background())
+    req.Method = http.MethodGet
+    req.Body = http.NoBody
+    req.ContentLength = 0
+    req.Header.Set(refreshHeader, "1")
+
+    select {
+    case rv.queue <- refreshJob{key: key, req: req}:
+        rv.pending[key] = struct{}{}
+    default:
+        atomic.AddInt64(&rv.dropped, 1)
+    }
+}
+
+func (rv *revalidator) work(config *CacheConfig) {
+    for job := range rv.queue {
+        rv.refresh(job, config)
+        rv.mu.Lock()
+        delete(rv.pending, job.key)
+        rv.mu.Unlock()
+    }
+}
+
+// refresh fetches one page through the coalescer, so misses for the same key
+// wait for the refresh instead of going to the backend as well
+func (rv *revalidator) refresh(job refreshJob, config *CacheConfig) {
+    f, leader := coalescer.join(job.key)
+    if !leader {
+        atomic.AddInt64(&rv.coalesced, 1)
+        return
+    }
+
+    entry, err := fetchAndStore(nil, job.req, job.key, config)
+    coalescer.finish(job.key, f, entry, err)
+    switch {
+    case err != nil:
+        atomic.AddInt64(&rv.failed, 1)
+        errorLog("Refresh of %s failed: %v\n", job.key, err)
+    case entry.NoStore != "":
+        atomic.AddInt64(&rv.uncacheable, 1)
+        if config.Debug {
+            warnLog("Refresh of %s not stored: %s\n", job.key, entry.NoStore)
+        }
+    default:
+        atomic.AddInt64(&rv.refreshed, 1)
+    }
+}
+
+// wantsRefresh reports a request asking to skip the cache. Only clients that
+// may purge get it, so the header cannot be used to flood the backend.
+func wantsRefresh(r *http.Request, config *CacheConfig) bool {
+    if r.Header.Get(refreshHeader) != "1" || !purgeAllowed(r, config) {
+        return false
+    }
+    if revalidation != nil {
+        atomic.AddInt64(&revalidation.bypassed, 1)
+    }
+    return true
+}
+
+func (rv *revalidator) snapshot() revalidatorSnapshot {
+    if rv == nil {
+        return revalidatorSnapshot{}
+    }
+    rv.mu.Lock()
+    pending := len(rv.pending)
+    rv.mu.Unlock()
+    return revalidatorSnapshot{
+        Workers:     rv.workers,
+        QueueDepth:  len(rv.queue),
+        QueueSize:   cap(rv.queue),
+        Pending:     pending,
+        Refreshed:   atomic.LoadInt64(&rv.refreshed),
+        Uncacheable: atomic.LoadInt64(&rv.uncacheable),
+        Failed:      atomic.LoadInt64(&rv.failed),
+        Coalesced:   atomic.LoadInt64(&rv.coalesced),
+        Skipped:     atomic.LoadInt64(&rv.skipped),
+        Dropped:     atomic.LoadInt64(&rv.dropped),
+        Bypassed:    atomic.LoadInt64(&rv.bypassed),
+    }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// idleRevalidator has a queue of size but no workers, so jobs stay queued
+func idleRevalidator(size int) *revalidator {
+    return &revalidator{queue: make(chan refreshJob, size), workers: 1, pending: make(map[string]struct{})}
+}
+
+func TestRevalidatorQueuesKeyOnce(t *testing.T) {
+    rv := idleRevalidator(10)
+    r := httptest.NewRequest(http.MethodPost, "http://shop.example/page", strings.NewReader("body"))
+
+    rv.schedule(r, "PAGE")
+    rv.schedule(r, "PAGE")
+    rv.schedule(r, "OTHER")
+    if snap := rv.snapshot(); snap.QueueDepth != 2 || snap.Pending != 2 || snap.Skipped != 1 {
+        t.Errorf("snapshot %+v, want 2 queued and the repeated key skipped", snap)
+    }
+
+    // The worker gets its own GET marked as a refresh
+    job := <-rv.queue
+    if job.key != "PAGE" || job.req.Method != http.MethodGet || job.req.Header.Get(refreshHeader) != "1" || job.req.ContentLength != 0 {
+        t.Errorf("job %s: %s with Refresh %q and %d body bytes", job.key, job.req.Method, job.req.Header.Get(refreshHeader), job.req.ContentLength)
+    }
+    if r.Method != http.MethodPost || r.Header.Get(refreshHeader) != "" {
+        t.Error("scheduling changed the client's request")
+    }
+}
+
+func TestRevalidatorDropsWhenFull(t *testing.T) {
+    rv := idleRevalidator(1)
+    r := httptest.NewRequest(http.MethodGet, "http://shop.example/page", nil)
+
+    rv.schedule(r, "FIRST")
+    rv.schedule(r, "SECOND")
+    if snap := rv.snapshot(); snap.QueueDepth != 1 || snap.Dropped != 1 || snap.Pending != 1 {
+        t.Errorf("snapshot %+v, want 1 queued and 1 dropped", snap)
+    }
+    // A dropped key can be queued again once there is room
+    <-rv.queue
+    rv.mu.Lock()
+    delete(rv.pending, "FIRST")
+    rv.mu.Unlock()
+    rv.schedule(r, "SECOND")
+    if snap := rv.snapshot(); snap.QueueDepth != 1 || snap.Pending != 1 {
+        t.Errorf("snapshot %+v, want the dropped key queued", snap)
+    }
+}
+
+func TestStalePageIsRefreshedInBackground(t *testing.T) {
+    useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Write([]byte("new page"))
+    })
+    config := loadConfig()
+    workerConfig := *config
+    workerConfig.RefreshWorkers = 1
+    saved := revalidation
+    revalidation = startRevalidator(&workerConfig)
+    t.Cleanup(func() {
+        close(revalidation.queue)
+        revalidation = saved
+    })
+
+    req := httptest.NewRequest(http.MethodGet, "http://shop.example/stale", nil)
+    key := getCacheKeyWithConfig(req, config)
+    localCache.Set(key, CacheEntry{Content: "old page", Expired: true, Created: time.Now()}, time.Hour)
+
+    if rec := getPage("/stale"); rec.Header().Get("Fast-Cache") != "STALE" || rec.Body.String() != "old page" {
+        t.Fatalf("got %s %q, want the stale page", rec.Header().Get("Fast-Cache"), rec.Body.String())
+    }
+    deadline := time.Now().Add(2 * time.Second)
+    for revalidation.snapshot().Refreshed == 0 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if rec := getPage("/stale"); rec.Header().Get("Fast-Cache") != "HIT" || rec.Body.String() != "new page" {
+        t.Errorf("got %s %q after the refresh, want the new page", rec.Header().Get("Fast-Cache"), rec.Body.String())
+    }
+}
+
+func TestRefreshHeaderNeedsPurgeAccess(t *testing.T) {
+    calls := useBackend(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Write([]byte("page"))
+    })
+    loadConfig().PurgeAllow = parseNetworks("127.0.0.1")
+    getPage("/refresh")
+
+    refresh := func(remoteAddr string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodGet, "http://shop.example/refresh", nil)
+        req.RemoteAddr = remoteAddr
+        req.Header.Set(refreshHeader, "1")
+        rec := httptest.NewRecorder()
+        handleRequest(rec, req)
+        return rec
+    }
+
+    if rec := refresh("192.0.2.1:40000"); rec.Header().Get("Fast-Cache") != "HIT" {
+        t.Errorf("outside PURGE_ALLOW: Fast-Cache %q, want HIT", rec.Header().Get("Fast-Cache"))
+    }
+    if got := atomic.LoadInt64(calls); got != 1 {
+        t.Errorf("outside PURGE_ALLOW: backend called %d times, want 1", got)
+    }
+    if rec := refresh("127.0.0.1:40000"); rec.Header().Get("Fast-Cache") != "MISS" {
+        t.Errorf("inside PURGE_ALLOW: Fast-Cache %q, want MISS", rec.Header().Get("Fast-Cache"))
+    }
+    if got := atomic.LoadInt64(calls); got != 2 {
+        t.Errorf("inside PURGE_ALLOW: backend called %d times, want 2", got)
+    }
+}
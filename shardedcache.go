@@ -0,0 +1,127 @@
+package main
+
+import (
+    "time"
+)
+
+// minShardBytes keeps shards large enough for big pages: with a small
+// CACHE_MAX_MB fewer shards are used instead of splitting it too thin
+const minShardBytes = 4 << 20
+
+// shardedCache spreads keys over independent pageCaches, each with its own
+// lock and share of the budget, so hits on different pages do not contend.
+// Eviction happens per shard, which approximates the policy over all pages.
+type shardedCache struct {
+    shards []*pageCache
+    mask   uint64
+}
+
+// newShardedCache splits maxBytes and maxEntries over shards stores, rounded
+// up to a power of two
+func newShardedCache(shards int, maxBytes int64, maxEntries int, policy string) *shardedCache {
+    n := 1
+    for n < shards {
+        n <<= 1
+    }
+    for n > 1 && maxBytes > 0 && maxBytes/int64(n) < minShardBytes {
+        n >>= 1
+    }
+
+    sc := &shardedCache{shards: make([]*pageCache, n), mask: uint64(n - 1)}
+    for i := range sc.shards {
+        shardEntries := 0
+        if maxEntries > 0 {
+            shardEntries = (maxEntries + n - 1) / n
+        }
+        sc.shards[i] = newPageCache(maxBytes/int64(n), shardEntries, policy)
+    }
+    return sc
+}
+
+// newLocalStore creates the local tier from CACHE_SHARDS, CACHE_MAX_MB,
+// CACHE_MAX_ENTRIES and CACHE_EVICTION
+func newLocalStore(config *CacheConfig) pageStore {
+    if config.CacheShards <= 1 {
+        return newPageCache(config.CacheMaxBytes, config.CacheMaxEntries, config.CacheEviction)
+    }
+    return newShardedCache(config.CacheShards, config.CacheMaxBytes, config.CacheMaxEntries, config.CacheEviction)
+}
+
+func (sc *shardedCache) shard(key string) *pageCache {
+    return sc.shards[hashKey(key)&sc.mask]
+}
+
+func (sc *shardedCache) Get(key string) (CacheEntry, bool) {
+    return sc.shard(key).Get(key)
+}
+
+func (sc *shardedCache) Contains(key string) bool {
+    return sc.shard(key).Contains(key)
+}
+
+func (sc *shardedCache) Set(key string, entry CacheEntry, ttl time.Duration) bool {
+    return sc.shard(key).Set(key, entry, ttl)
+}
+
+func (sc *shardedCache) Delete(key string) {
+    sc.shard(key).Delete(key)
+}
+
+func (sc *shardedCache) Flush() {
+    for _, shard := range sc.shards {
+        shard.Flush()
+    }
+}
+
+func (sc *shardedCache) Items() map[string]pageCacheItem {
+    items := make(map[string]pageCacheItem)
+    for _, shard := range sc.shards {
+        for key, item := range shard.Items() {
+            items[key] = item
+        }
+    }
+    return items
+}
+
+func (sc *shardedCache) setOnRemoved(fn func(key string, entry CacheEntry, reason removalReason)) {
+    for _, shard := range sc.shards {
+        shard.setOnRemoved(fn)
+    }
+}
+
+func (sc *shardedCache) setStaleCopy(fn func(entry CacheEntry) (CacheEntry, time.Duration, bool)) {
+    for _, shard := range sc.shards {
+        shard.setStaleCopy(fn)
+    }
+}
+
+// startJanitor sweeps one shard at a time, so only a single shard is locked
+// for writes at any moment
+func (sc *shardedCache) startJanitor(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            for _, shard := range sc.shards {
+                shard.deleteExpired()
+            }
+        }
+    }()
+}
+
+// snapshot adds up the statistics of all shards
+func (sc *shardedCache) snapshot() pageCacheSnapshot {
+    total := pageCacheSnapshot{Shards: len(sc.shards)}
+    for _, shard := range sc.shards {
+        s := shard.snapshot()
+        total.Policy = s.Policy
+        total.Entries += s.Entries
+        total.Bytes += s.Bytes
+        total.MaxBytes += s.MaxBytes
+        total.MaxEntries += s.MaxEntries
+        total.Hits += s.Hits
+        total.Misses += s.Misses
+        total.Expirations += s.Expirations
+        total.Evictions += s.Evictions
+        total.Rejections += s.Rejections
+    }
+    return total
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// Pages and body size used by the benchmarks
+const (
+    benchPages    = 10000
+    benchPageSize = 16 << 10
+    benchShards   = 64
+)
+
+// discardWriter is a ResponseWriter that drops the body, reused across requests
+type discardWriter struct {
+    header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteString(s string) (int, error) {
+    return len(s), nil
+}
+func (w *discardWriter) WriteHeader(int) {}
+
+// benchStores are the local tiers the benchmarks compare
+var benchStores = []struct {
+    name  string
+    store func() pageStore
+}{
+    {"single", func() pageStore { return newPageCache(0, 0, "lru") }},
+    {fmt.Sprintf("sharded-%d", benchShards), func() pageStore { return newShardedCache(benchShards, 0, 0, "lru") }},
+}
+
+// fillBenchStore adds benchPages pages sharing one body
+func fillBenchStore(store pageStore) []string {
+    body := strings.Repeat("x", benchPageSize)
+    keys := make([]string, benchPages)
+    for i := range keys {
+        keys[i] = fmt.Sprintf("%040X", i)
+        store.Set(keys[i], CacheEntry{
+            Content: body,
+            Headers: http.Header{"Content-Type": {"text/html; charset=UTF-8"}},
+            Created: time.Now(),
+        }, time.Hour)
+    }
+    return keys
+}
+
+func TestShardedCacheSplitsBudget(t *testing.T) {
+    sc := newShardedCache(10, 16*minShardBytes, 100, "lru")
+    if len(sc.shards) != 16 {
+        t.Fatalf("%d shards, want 10 rounded up to 16", len(sc.shards))
+    }
+    if sc.shards[0].maxBytes != minShardBytes || sc.shards[0].maxEntries != 7 {
+        t.Errorf("shard budget %d bytes / %d entries, want %d / 7", sc.shards[0].maxBytes, sc.shards[0].maxEntries, minShardBytes)
+    }
+    if small := newShardedCache(64, 2*minShardBytes, 0, "lru"); len(small.shards) != 2 {
+        t.Errorf("%d shards for a 2 shard budget, want 2", len(small.shards))
+    }
+
+    store := newShardedCache(8, 0, 0, "lru")
+    keys := make([]string, 100)
+    for i := range keys {
+        keys[i] = fmt.Sprintf("%040X", i)
+        store.Set(keys[i], CacheEntry{Content: keys[i]}, time.Hour)
+    }
+    for _, key := range keys {
+        if entry, ok := store.Get(key); !ok || entry.Content != key {
+            t.Fatalf("Get(%s) = %q, %v", key, entry.Content, ok)
+        }
+    }
+    store.Delete(keys[0])
+    if store.Contains(keys[0]) {
+        t.Errorf("%s still cached after Delete", keys[0])
+    }
+}
+
+// Each shard sizes its TinyLFU sketch from its own part of the budget
+func TestShardedTinyLFUSketchFollowsBudget(t *testing.T) {
+    single := newPageCache(512<<20, 0, "tinylfu")
+    sharded := newShardedCache(64, 512<<20, 0, "tinylfu")
+    whole := len(single.admission.rows[0])
+    if whole < (512<<20)/tinyLFUPageSize {
+        t.Errorf("sketch width %d for a 512 MB store, want at least %d", whole, (512<<20)/tinyLFUPageSize)
+    }
+    var total int
+    for _, shard := range sharded.shards {
+        total += len(shard.admission.rows[0])
+    }
+    if total > 2*whole {
+        t.Errorf("64 shards hold sketches %d wide in total, a single store needs %d", total, whole)
+    }
+    if width := len(newPageCache(0, 100, "tinylfu").admission.rows[0]); width != 256 {
+        t.Errorf("sketch width %d for 100 entries, want the minimum 256", width)
+    }
+}
+
+// benchGet looks the first hot of the pages up from every goroutine,
+// replacing setPercent percent of them instead. Workers cannot stop the
+// benchmark, so misses are counted and reported afterwards.
+func benchGet(b *testing.B, hot, setPercent int) {
+    for _, s := range benchStores {
+        b.Run(s.name, func(b *testing.B) {
+            store := s.store()
+            keys := fillBenchStore(store)[:hot]
+            var seed, misses uint64
+            b.ReportAllocs()
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                i := atomic.AddUint64(&seed, 7919)
+                for pb.Next() {
+                    i++
+                    key := keys[i%uint64(len(keys))]
+                    if setPercent > 0 && int(i%100) < setPercent {
+                        entry, _ := store.Get(key)
+                        store.Set(key, entry, time.Hour)
+                        continue
+                    }
+                    if _, ok := store.Get(key); !ok {
+                        atomic.AddUint64(&misses, 1)
+                    }
+                }
+            })
+            if misses > 0 {
+                b.Errorf("%d lookups missed", misses)
+            }
+        })
+    }
+}
+
+func BenchmarkShardedGet(b *testing.B) {
+    benchGet(b, benchPages, 0)
+}
+
+func BenchmarkShardedGetSet(b *testing.B) {
+    benchGet(b, benchPages, 10)
+}
+
+// BenchmarkShardedHotGetSet has every core on a few popular pages while they
+// are being replaced, where a single lock makes readers queue behind writers
+func BenchmarkShardedHotGetSet(b *testing.B) {
+    benchGet(b, 256, 10)
+}
+
+// BenchmarkShardedHitPath runs what handleRequest does for a local hit: build
+// the cache key, look it up and write the page
+func BenchmarkShardedHitPath(b *testing.B) {
+    config := loadConfig()
+    for _, s := range benchStores {
+        b.Run(s.name, func(b *testing.B) {
+            store := s.store()
+            entry := CacheEntry{
+                Content: strings.Repeat("x", benchPageSize),
+                Headers: http.Header{"Content-Type": {"text/html; charset=UTF-8"}},
+                Created: time.Now(),
+            }
+            requests := make([]*http.Request, 256)
+            for i := range requests {
+                r, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://shop.example/catalog/p%d.html?color=%d", i, i%7), nil)
+                requests[i] = r
+                store.Set(getCacheKeyWithConfig(r, config), entry, time.Hour)
+            }
+
+            var seed, misses uint64
+            b.ReportAllocs()
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                w := &discardWriter{header: make(http.Header)}
+                i := atomic.AddUint64(&seed, 7919)
+                for pb.Next() {
+                    i++
+                    r := requests[i%uint64(len(requests))]
+                    entry, ok := store.Get(getCacheKeyWithConfig(r, config))
+                    if !ok {
+                        atomic.AddUint64(&misses, 1)
+                        continue
+                    }
+                    for key := range w.header {
+                        delete(w.header, key)
+                    }
+                    serveContent(w, entry, time.Now(), "HIT")
+                }
+            })
+            if misses > 0 {
+                b.Errorf("%d lookups missed", misses)
+            }
+        })
+    }
+}
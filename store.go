@@ -0,0 +1,131 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "strings"
+)
+
+const (
+    // Magento\Store\Model\StoreManager::PARAM_RUN_TYPE and PARAM_RUN_CODE
+    runTypeParam = "MAGE_RUN_TYPE"
+    runCodeParam = "MAGE_RUN_CODE"
+
+    // Magento\Store\Api\StoreCookieManagerInterface keeps the selected store view here
+    storeCookieName = "store"
+)
+
+// storeRun is the MAGE_RUN_TYPE/MAGE_RUN_CODE pair the web server passes to
+// Magento for a host
+type storeRun struct {
+    Type string
+    Code string
+}
+
+// storeMap resolves request hosts to store runs like the nginx/Apache map in
+// front of Magento. Entries are exact hosts, "*.domain" suffixes or "*".
+type storeMap struct {
+    hosts    map[string]storeRun
+    suffixes []storeMapSuffix
+    fallback *storeRun
+}
+
+type storeMapSuffix struct {
+    suffix string
+    run    storeRun
+}
+
+// parseStoreMap reads STORE_MAP, e.g. "shop.de=website:de,*.shop.fr=store:fr,*=website:base"
+func parseStoreMap(spec string) storeMap {
+    m := storeMap{hosts: make(map[string]storeRun)}
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        host, target, ok := strings.Cut(entry, "=")
+        runType, runCode, okRun := strings.Cut(target, ":")
+        host = strings.ToLower(strings.TrimSpace(host))
+        run := storeRun{Type: strings.TrimSpace(runType), Code: strings.TrimSpace(runCode)}
+        if !ok || !okRun || host == "" || run.Type == "" || run.Code == "" {
+            warnLog("Warning: ignoring invalid STORE_MAP entry %q, expected host=type:code\n", entry)
+            continue
+        }
+        if run.Type != "website" && run.Type != "store" {
+            warnLog("Warning: STORE_MAP entry %q has run type %q, Magento expects website or store\n", entry, run.Type)
+        }
+
+        switch {
+        case host == "*":
+            m.fallback = &run
+        case strings.HasPrefix(host, "*."):
+            m.suffixes = append(m.suffixes, storeMapSuffix{suffix: host[1:], run: run})
+        default:
+            m.hosts[host] = run
+        }
+    }
+    return m
+}
+
+// resolve returns the store run for host; the port is ignored
+func (m storeMap) resolve(host string) (storeRun, bool) {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+    if run, ok := m.hosts[host]; ok {
+        return run, true
+    }
+    // Longest suffix wins, so *.b.shop.com beats *.shop.com
+    best := -1
+    for i, s := range m.suffixes {
+        if strings.HasSuffix(host, s.suffix) && (best < 0 || len(s.suffix) > len(m.suffixes[best].suffix)) {
+            best = i
+        }
+    }
+    if best >= 0 {
+        return m.suffixes[best].run, true
+    }
+    if m.fallback != nil {
+        return *m.fallback, true
+    }
+    return storeRun{}, false
+}
+
+// magentoHost is the Host Magento sees for r: the client's Host when
+// PRESERVE_HOST is on, otherwise the single HOST setting
+func magentoHost(r *http.Request, config *CacheConfig) string {
+    if !config.PreserveHost && config.Host != "" {
+        return config.Host
+    }
+    return r.Host
+}
+
+// identifierExtras are the values Magento adds to the page identifier besides
+// the URI and vary string, in the order IdentifierStoreReader adds them
+func identifierExtras(r *http.Request, config *CacheConfig) []phpKeyValue {
+    var extras []phpKeyValue
+    if run, ok := config.Stores.resolve(magentoHost(r, config)); ok {
+        extras = append(extras,
+            phpKeyValue{Key: runTypeParam, Value: run.Type},
+            phpKeyValue{Key: runCodeParam, Value: run.Code})
+    }
+    return extras
+}
+
+// storeCookieWithoutVary reports a store view switched by cookie whose vary
+// cookie is missing and cannot be computed from STORE_VIEWS. Magento only
+// keeps the store cookie for non-default views and always sets X-Magento-Vary
+// with it, so such a request would be keyed as the default view and must go
+// to the backend instead.
+func storeCookieWithoutVary(r *http.Request, config *CacheConfig) bool {
+    if store, found := phpCookie(r, storeCookieName); !found || store == "" {
+        return false
+    }
+    if varyString(r) != nil {
+        return false
+    }
+    _, computed := contextVary(r, config)
+    return !computed
+}
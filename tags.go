@@ -0,0 +1,200 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Magento lists the cache tags of every cacheable page in this header
+const magentoTagsHeader = "X-Magento-Tags"
+
+var (
+    localTags = newTagIndex() // Tag → key index of the local cache
+)
+
+// tagIndex maps cache tags to the local cache keys of the pages carrying them
+type tagIndex struct {
+    mu   sync.RWMutex
+    keys map[string]map[string]struct{} // tag → keys
+    tags map[string][]string            // key → tags
+}
+
+func newTagIndex() *tagIndex {
+    return &tagIndex{
+        keys: make(map[string]map[string]struct{}),
+        tags: make(map[string][]string),
+    }
+}
+
+// set replaces the tags recorded for key
+func (ti *tagIndex) set(key string, tags []string) {
+    ti.mu.Lock()
+    defer ti.mu.Unlock()
+
+    ti.removeLocked(key)
+    if len(tags) == 0 {
+        return
+    }
+    ti.tags[key] = tags
+    for _, tag := range tags {
+        keys, ok := ti.keys[tag]
+        if !ok {
+            keys = make(map[string]struct{})
+            ti.keys[tag] = keys
+        }
+        keys[key] = struct{}{}
+    }
+}
+
+// remove forgets key and drops tags that no longer have pages
+func (ti *tagIndex) remove(key string) {
+    ti.mu.Lock()
+    defer ti.mu.Unlock()
+    ti.removeLocked(key)
+}
+
+func (ti *tagIndex) removeLocked(key string) {
+    for _, tag := range ti.tags[key] {
+        if keys, ok := ti.keys[tag]; ok {
+            delete(keys, key)
+            if len(keys) == 0 {
+                delete(ti.keys, tag)
+            }
+        }
+    }
+    delete(ti.tags, key)
+}
+
+// reset forgets every key
+func (ti *tagIndex) reset() {
+    ti.mu.Lock()
+    defer ti.mu.Unlock()
+    ti.keys = make(map[string]map[string]struct{})
+    ti.tags = make(map[string][]string)
+}
+
+// keysFor returns the keys of all pages tagged with any of tags
+func (ti *tagIndex) keysFor(tags ...string) []string {
+    ti.mu.RLock()
+    defer ti.mu.RUnlock()
+
+    seen := make(map[string]struct{})
+    var keys []string
+    for _, tag := range tags {
+        for key := range ti.keys[tag] {
+            if _, ok := seen[key]; !ok {
+                seen[key] = struct{}{}
+                keys = append(keys, key)
+            }
+        }
+    }
+    return keys
+}
+
+// parseTags splits an X-Magento-Tags value into individual tags
+func parseTags(header string) []string {
+    var tags []string
+    seen := make(map[string]bool)
+    for _, tag := range strings.Split(header, ",") {
+        tag = strings.TrimSpace(tag)
+        if tag != "" && !seen[tag] {
+            seen[tag] = true
+            tags = append(tags, tag)
+        }
+    }
+    return tags
+}
+
+// setLocal stores entry in the local cache, indexes its tags and keeps a copy
+// on disk. Pages never outlive the lifetime the origin gave them.
+func setLocal(key string, entry CacheEntry, config *CacheConfig) {
+    ttl, fresh := localTTL(entry, config.CacheTTL)
+    if !fresh {
+        evictLocal(key)
+        return
+    }
+    cacheLocal(key, entry, ttl, config)
+    diskCache.save(key, entry)
+}
+
+// cacheLocal puts entry in the memory tier for ttl
+func cacheLocal(key string, entry CacheEntry, ttl time.Duration, config *CacheConfig) {
+    if localCache.Set(key, entry, ttl) {
+        localTags.set(key, entry.Tags)
+    }
+    keepGrace(key, entry, config)
+}
+
+// evictLocal removes key from the local cache and the disk without keeping a
+// stale copy
+func evictLocal(key string) {
+    localCache.Delete(key)
+    localTags.remove(key)
+    diskCache.evict(key)
+}
+
+// flushLocal empties every local tier
+func flushLocal() {
+    if localCache == nil {
+        return
+    }
+    flushMemory()
+    if graceCache != nil {
+        graceCache.Flush()
+    }
+    diskCache.flush()
+}
+
+// flushMemory empties the local cache and its tag index
+func flushMemory() {
+    if localCache == nil {
+        return
+    }
+    localCache.Flush()
+    localTags.reset()
+}
+
+// purgeLocalTags evicts every local page carrying one of tags and returns the count
+func purgeLocalTags(tags ...string) int {
+    if localCache == nil {
+        return 0
+    }
+    keys := localTags.keysFor(tags...)
+    for _, key := range keys {
+        evictLocal(key)
+    }
+    match := func(pageTags []string) bool { return hasAnyTag(pageTags, tags) }
+    purgeGrace(match, keys...)
+    diskCache.purge(match)
+    return len(keys)
+}
+
+// handleSecuredPurge evicts local pages by tag: /cache/purge?tags=cat_p_123,cms_b_footer
+func handleSecuredPurge(w http.ResponseWriter, r *http.Request) {
+    if !authorizeAdmin(w, r) {
+        return
+    }
+
+    tags := parseTags(r.URL.Query().Get("tags"))
+    if len(tags) == 0 {
+        tags = parseTags(r.Header.Get(magentoTagsHeader))
+    }
+    if len(tags) == 0 {
+        http.Error(w, "no tags given", http.StatusBadRequest)
+        return
+    }
+
+    purged := purgeLocalTags(tags...)
+    if config := loadConfig(); config.Debug {
+        debugLog("🧹 Purged %d local pages for tags %s\n", purged, strings.Join(tags, ","))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "tags":   tags,
+        "purged": purged,
+    })
+}
@@ -0,0 +1,112 @@
+<?php
+return [
+    'backend' => [
+        'frontName' => 'admin_q1w2e3'
+    ],
+    'remote_storage' => [
+        'driver' => 'file'
+    ],
+    'queue' => [
+        'consumers_wait_for_messages' => 1
+    ],
+    'crypt' => [
+        'key' => 'base64Yk5HQ0Zyd2lFR0xZWFRhT0JzR2tGeG1JUkdPc1p5cWE='
+    ],
+    'db' => [
+        'table_prefix' => '',
+        'connection' => [
+            'default' => [
+                'host' => 'db',
+                'dbname' => 'magento',
+                'username' => 'magento',
+                'password' => 'it\'s "secret"',
+                'model' => 'mysql4',
+                'engine' => 'innodb',
+                'initStatements' => 'SET NAMES utf8;',
+                'active' => '1',
+                'driver_options' => [
+                    1014 => false
+                ]
+            ]
+        ]
+    ],
+    'resource' => [
+        'default_setup' => [
+            'connection' => 'default'
+        ]
+    ],
+    'x-frame-options' => 'SAMEORIGIN',
+    'MAGE_MODE' => 'production',
+    'session' => [
+        'save' => 'redis',
+        'redis' => [
+            'host' => 'redis',
+            'port' => '6379',
+            'database' => '2',
+            'disable_locking' => '1'
+        ]
+    ],
+    'cache' => [
+        'graphql' => [
+            'id_salt' => 'x9KfGqTz3bVnLw2PjRmHcYdE5sAu7NoQ'
+        ],
+        'frontend' => [
+            'default' => [
+                'id_prefix' => '40d_',
+                'backend' => 'Magento\\Framework\\Cache\\Backend\\Redis',
+                'backend_options' => [
+                    'server' => 'redis',
+                    'database' => '0',
+                    'port' => '6379',
+                    'password' => '',
+                    'compress_data' => '1',
+                    'compression_lib' => ''
+                ]
+            ],
+            // Full page cache in its own database, added by the deploy script
+            'page_cache' => [
+                'id_prefix' => '40d_',
+                'backend' => 'Magento\\Framework\\Cache\\Backend\\Redis',
+                'backend_options' => [
+                    'server' => 'tcp://redis-fpc', # no TLS inside the cluster
+                    'database' => '1',
+                    'port' => '6380',
+                    'password' => '',
+                    'compress_data' => '0',
+                    'compress_tags' => '1',
+                    'compression_lib' => 'gzip',
+                ]
+            ]
+        ],
+        /* 'allow_parallel_generation' => true, */
+        'allow_parallel_generation' => false
+    ],
+    'lock' => [
+        'provider' => 'db'
+    ],
+    'directories' => [
+        'document_root_is_pub' => true
+    ],
+    'cache_types' => [
+        'config' => 1,
+        'layout' => 1,
+        'block_html' => 1,
+        'collections' => 1,
+        'reflection' => 1,
+        'db_ddl' => 1,
+        'compiled_config' => 1,
+        'eav' => 1,
+        'customer_notification' => 1,
+        'config_integration' => 1,
+        'config_integration_api' => 1,
+        'full_page' => 1,
+        'config_webservice' => 1,
+        'translate' => 1
+    ],
+    'downloadable_domains' => [
+        'shop.example'
+    ],
+    'install' => [
+        'date' => 'Tue, 02 Jan 2024 10:00:00 +0000'
+    ]
+];
@@ -0,0 +1,173 @@
+package main
+
+import (
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+const (
+    // Magento\Store\Model\StoreManagerInterface::CONTEXT_STORE and
+    // Magento\Framework\App\Http\Context::CONTEXT_CURRENCY
+    contextStore    = "store"
+    contextCurrency = "current_currency"
+
+    // Magento\Store\Api\StoreResolverInterface::PARAM_NAME, read before the store cookie
+    storeParamName = "___store"
+)
+
+// storeView is one store view of STORE_VIEWS with its default display currency
+type storeView struct {
+    Website  string
+    Code     string
+    Currency string
+}
+
+// storeViews knows which store views belong to which website. The first view
+// listed for a website is its default store, like Magento's website default.
+type storeViews struct {
+    views    map[string]storeView
+    defaults map[string]string // website → default store code
+}
+
+// parseStoreViews reads STORE_VIEWS, e.g. "base:default:USD,base:fr:EUR,de:de:EUR"
+func parseStoreViews(spec string) storeViews {
+    sv := storeViews{views: make(map[string]storeView), defaults: make(map[string]string)}
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        parts := strings.Split(entry, ":")
+        if len(parts) != 3 {
+            warnLog("Warning: ignoring invalid STORE_VIEWS entry %q, expected website:store:currency\n", entry)
+            continue
+        }
+        view := storeView{
+            Website:  strings.TrimSpace(parts[0]),
+            Code:     strings.TrimSpace(parts[1]),
+            Currency: strings.TrimSpace(parts[2]),
+        }
+        if view.Website == "" || view.Code == "" || view.Currency == "" {
+            warnLog("Warning: ignoring invalid STORE_VIEWS entry %q, expected website:store:currency\n", entry)
+            continue
+        }
+        if _, dup := sv.views[view.Code]; dup {
+            warnLog("Warning: STORE_VIEWS lists store %q twice, keeping the first\n", view.Code)
+            continue
+        }
+        sv.views[view.Code] = view
+        if _, ok := sv.defaults[view.Website]; !ok {
+            sv.defaults[view.Website] = view.Code
+        }
+    }
+    return sv
+}
+
+// website returns the website a store run belongs to
+func (sv storeViews) website(run storeRun) (string, bool) {
+    if run.Type == "store" {
+        view, ok := sv.views[run.Code]
+        return view.Website, ok
+    }
+    _, ok := sv.defaults[run.Code]
+    return run.Code, ok
+}
+
+// requestVary returns the vary string Magento keys the request with: the
+// X-Magento-Vary parameter or cookie, otherwise the HttpContext vary computed
+// for an anonymous visitor when STORE_VIEWS describes the store
+func requestVary(r *http.Request, config *CacheConfig) interface{} {
+    if vary := varyString(r); vary != nil {
+        return vary
+    }
+    if vary, ok := contextVary(r, config); ok {
+        return vary
+    }
+    return nil
+}
+
+// contextVary reproduces Http\Context::getVaryString() for an anonymous
+// visitor the way Store's action context plugin fills it: the store from the
+// ___store parameter or store cookie and its currency, each compared with the
+// website's default store. Customer group, login and tax rates stay at their
+// defaults until a customer logs in, so they never show up here. It reports
+// false when the store setup is unknown and the request cannot be keyed.
+func contextVary(r *http.Request, config *CacheConfig) (interface{}, bool) {
+    run, ok := config.Stores.resolve(magentoHost(r, config))
+    if !ok {
+        return nil, false
+    }
+    website, ok := config.StoreViews.website(run)
+    if !ok {
+        return nil, false
+    }
+    defaultView := config.StoreViews.views[config.StoreViews.defaults[website]]
+
+    current := defaultView
+    if run.Type == "store" {
+        current = config.StoreViews.views[run.Code]
+    }
+    requested, found := phpQueryParam(r.URL.RawQuery, storeParamName)
+    if !found {
+        requested, found = phpCookie(r, storeCookieName)
+    }
+    if found && requested != "" {
+        view, known := config.StoreViews.views[requested]
+        if !known {
+            // Magento only answers for stores it knows; let it decide
+            return nil, false
+        }
+        // A store of another website is ignored by the store resolver
+        if view.Website == website {
+            current = view
+        }
+    }
+
+    currency := current.Currency
+    if config.CurrencyCookie != "" {
+        if code, found := phpCookie(r, config.CurrencyCookie); found && code != "" {
+            currency = code
+        }
+    }
+
+    // Http\Context::getData() drops values equal to their default, then
+    // getVaryString() ksorts what is left and hashes its JSON, since 2.4.7
+    // with sha256 salted by the crypt key instead of a plain sha1
+    var data []phpKeyValue
+    if current.Code != defaultView.Code {
+        data = append(data, phpKeyValue{Key: contextStore, Value: current.Code})
+    }
+    if currency != defaultView.Currency {
+        data = append(data, phpKeyValue{Key: contextCurrency, Value: currency})
+    }
+    if len(data) == 0 {
+        return nil, true
+    }
+    sort.Slice(data, func(i, j int) bool { return data[i].Key < data[j].Key })
+
+    jsonStr, err := phpJSONEncode(data)
+    if err != nil {
+        return nil, false
+    }
+    if magentoAtLeast(config, "2.4.7") {
+        if config.CryptKey == "" {
+            return nil, false
+        }
+        sum := sha256.Sum256([]byte(jsonStr + "|" + config.CryptKey))
+        return hex.EncodeToString(sum[:]), true
+    }
+    sum := sha1.Sum([]byte(jsonStr))
+    return hex.EncodeToString(sum[:]), true
+}
+
+// checkVarySalt warns when STORE_VIEWS cannot be used because Magento 2.4.7+
+// salts the vary string with a crypt key that is not configured
+func checkVarySalt(config *CacheConfig) {
+    if len(config.StoreViews.views) > 0 && config.CryptKey == "" && magentoAtLeast(config, "2.4.7") {
+        warnLog("Warning: STORE_VIEWS needs CRYPT_KEY (crypt/key of env.php) on Magento 2.4.7+, switched store views bypass the cache\n")
+    }
+}
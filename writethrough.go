@@ -0,0 +1,98 @@
+package main
+
+import "sync/atomic"
+
+// writeThrough is started by main when REDIS_WRITE_THROUGH is on
+var writeThrough *redisWriter
+
+// redisWrite is one page waiting to be saved to Redis
+type redisWrite struct {
+    key   string
+    entry CacheEntry
+}
+
+// redisWriter saves pages to Redis with a fixed number of workers fed by a
+// bounded queue, so a slow Redis holds back writes instead of goroutines
+type redisWriter struct {
+    queue   chan redisWrite
+    workers int
+
+    written int64 // Pages saved to Redis
+    failed  int64 // Saves Redis failed
+    dropped int64 // Pages not saved because the queue was full
+}
+
+// redisWriterSnapshot is the JSON form of redisWriter
+type redisWriterSnapshot struct {
+    Workers    int   `json:"workers"`
+    QueueDepth int   `json:"queue_depth"`
+    QueueSize  int   `json:"queue_size"`
+    Written    int64 `json:"written"`
+    Failed     int64 `json:"failed"`
+    Dropped    int64 `json:"dropped"`
+}
+
+// startRedisWriter launches REDIS_WRITE_WORKERS workers behind a
+// REDIS_WRITE_QUEUE sized queue
+func startRedisWriter(config *CacheConfig) *redisWriter {
+    rw := newRedisWriter(config.WriteWorkers, config.WriteQueue)
+    for i := 0; i < rw.workers; i++ {
+        go rw.work(config)
+    }
+    return rw
+}
+
+func newRedisWriter(workers, size int) *redisWriter {
+    if workers < 1 {
+        workers = 1
+    }
+    if size < 0 {
+        size = 0
+    }
+    return &redisWriter{queue: make(chan redisWrite, size), workers: workers}
+}
+
+// save queues entry to be written under key when the breaker lets Redis be
+// used. A full queue drops the write and hands a half-open trial on.
+func (rw *redisWriter) save(key string, entry CacheEntry) {
+    if rw == nil || !redisState.allow() {
+        return
+    }
+    select {
+    case rw.queue <- redisWrite{key: key, entry: entry}:
+    default:
+        redisState.release()
+        atomic.AddInt64(&rw.dropped, 1)
+    }
+}
+
+func (rw *redisWriter) work(config *CacheConfig) {
+    for job := range rw.queue {
+        redisCtx, cancel := redisContext()
+        err := saveRedisEntry(redisCtx, job.key, job.entry, job.entry.Tags, job.entry.Lifetime)
+        cancel()
+        if err != nil {
+            atomic.AddInt64(&rw.failed, 1)
+            errorLog("Redis write-through failed for %s: %v\n", job.key, err)
+            continue
+        }
+        atomic.AddInt64(&rw.written, 1)
+        if config.Debug {
+            debugLog("💾 Stored %s in Redis\n", job.key)
+        }
+    }
+}
+
+func (rw *redisWriter) snapshot() redisWriterSnapshot {
+    if rw == nil {
+        return redisWriterSnapshot{}
+    }
+    return redisWriterSnapshot{
+        Workers:    rw.workers,
+        QueueDepth: len(rw.queue),
+        QueueSize:  cap(rw.queue),
+        Written:    atomic.LoadInt64(&rw.written),
+        Failed:     atomic.LoadInt64(&rw.failed),
+        Dropped:    atomic.LoadInt64(&rw.dropped),
+    }
+}
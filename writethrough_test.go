@@ -0,0 +1,48 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestRedisWriterSavesInBackground(t *testing.T) {
+    f := useFakeRedis(t)
+    config := *loadConfig()
+    config.WriteWorkers = 2
+    config.WriteQueue = 10
+    rw := startRedisWriter(&config)
+    t.Cleanup(func() { close(rw.queue) })
+
+    rw.save("PAGE", CacheEntry{Content: "page", Created: time.Now(), Tags: []string{"cat_p_1"}})
+    deadline := time.Now().Add(2 * time.Second)
+    for rw.snapshot().Written == 0 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if f.record("PAGE") == nil {
+        t.Fatal("page not written to Redis")
+    }
+    if snap := rw.snapshot(); snap.Written != 1 || snap.Workers != 2 || snap.QueueSize != 10 {
+        t.Errorf("snapshot %+v, want 1 written by 2 workers behind a queue of 10", snap)
+    }
+}
+
+func TestRedisWriterDropsWhenFull(t *testing.T) {
+    useFakeRedis(t)
+    rw := newRedisWriter(1, 1) // No workers, the queue stays full
+
+    rw.save("FIRST", CacheEntry{Content: "page"})
+    rw.save("SECOND", CacheEntry{Content: "page"})
+    if snap := rw.snapshot(); snap.QueueDepth != 1 || snap.Dropped != 1 {
+        t.Fatalf("snapshot %+v, want 1 queued and 1 dropped", snap)
+    }
+
+    // A dropped half-open trial goes to the next request
+    redisState = &redisHealth{state: redisDegraded, openUntil: time.Now().Add(-time.Second)}
+    rw.save("THIRD", CacheEntry{Content: "page"})
+    if rw.snapshot().Dropped != 2 {
+        t.Fatal("third save not dropped")
+    }
+    if !redisState.allow() {
+        t.Error("dropped save kept the half-open trial")
+    }
+}